@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// APIトークンのスコープ
+const (
+	apiTokenScopeReadLivecomments  = "read:livecomments"
+	apiTokenScopeWriteLivecomments = "write:livecomments"
+	apiTokenScopeModerate          = "moderate"
+	apiTokenScopeStats             = "stats"
+)
+
+const (
+	apiTokenPrefix      = "isu_"
+	apiTokenRandomBytes = 32
+	maxAPITokenName     = 255
+	maxAPITokensPerUser = 20
+	// 最終利用時刻は、この間隔より頻繁には書き込まない
+	apiTokenTouchInterval = 1 * time.Minute
+)
+
+var apiTokenScopes = []string{
+	apiTokenScopeReadLivecomments,
+	apiTokenScopeWriteLivecomments,
+	apiTokenScopeModerate,
+	apiTokenScopeStats,
+}
+
+type APITokenModel struct {
+	ID     int64  `db:"id"`
+	UserID int64  `db:"user_id"`
+	Name   string `db:"name"`
+	// トークンのハッシュ。トークンそのものはサーバに残さない
+	TokenHash  string `db:"token_hash"`
+	Scopes     string `db:"scopes"`
+	CreatedAt  int64  `db:"created_at"`
+	LastUsedAt *int64 `db:"last_used_at"`
+	ExpiresAt  *int64 `db:"expires_at"`
+}
+
+func (m *APITokenModel) ScopeList() []string {
+	return strings.Split(m.Scopes, ",")
+}
+
+type APIToken struct {
+	ID         int64    `json:"id"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  int64    `json:"created_at"`
+	LastUsedAt *int64   `json:"last_used_at"`
+	ExpiresAt  *int64   `json:"expires_at"`
+}
+
+type PostAPITokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// 0なら無期限
+	ExpiresInSeconds int64 `json:"expires_in_seconds"`
+}
+
+type PostAPITokenResponse struct {
+	APIToken
+	// トークンそのもの。作成時にのみ返す
+	Token string `json:"token"`
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateAPIToken() (string, error) {
+	b := make([]byte, apiTokenRandomBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// 有効期限内のトークンと、その持ち主のユーザ名を返す。なければnil
+func findAPIToken(ctx context.Context, tokenHash string, now int64) (*APITokenModel, string, error) {
+	var tokenModel APITokenModel
+	if err := dbConn.GetContext(ctx, &tokenModel, "SELECT * FROM api_tokens WHERE token_hash = ? AND (expires_at IS NULL OR expires_at > ?)", tokenHash, now); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+
+	var username string
+	if err := dbConn.GetContext(ctx, &username, "SELECT name FROM users WHERE id = ?", tokenModel.UserID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+
+	return &tokenModel, username, nil
+}
+
+// 最終利用時刻を更新する
+func touchAPIToken(ctx context.Context, tokenModel *APITokenModel, now int64) error {
+	if tokenModel.LastUsedAt != nil && now-*tokenModel.LastUsedAt < int64(apiTokenTouchInterval/time.Second) {
+		return nil
+	}
+	if _, err := dbConn.ExecContext(ctx, "UPDATE api_tokens SET last_used_at = ? WHERE id = ?", now, tokenModel.ID); err != nil {
+		return err
+	}
+	tokenModel.LastUsedAt = &now
+	return nil
+}
+
+// APIトークンの一覧
+// GET /api/user/me/tokens
+func getAPITokensHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := getAuthUserID(c)
+
+	var tokenModels []APITokenModel
+	if err := dbConn.SelectContext(ctx, &tokenModels, "SELECT * FROM api_tokens WHERE user_id = ? ORDER BY id DESC", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get API tokens: "+err.Error())
+	}
+
+	tokens := make([]APIToken, len(tokenModels))
+	for i := range tokenModels {
+		tokens[i] = fillAPITokenResponse(tokenModels[i])
+	}
+
+	return c.JSON(http.StatusOK, tokens)
+}
+
+// APIトークンの作成
+// トークンそのものはこのレスポンスでしか返さない
+// POST /api/user/me/tokens
+func postAPITokenHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	userID := getAuthUserID(c)
+
+	var req *PostAPITokenRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "request body must be a json object")
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > maxAPITokenName {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("name must be between 1 and %d bytes", maxAPITokenName))
+	}
+	if len(req.Scopes) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "scopes must not be empty")
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(apiTokenScopes, scope) {
+			return echo.NewHTTPError(http.StatusBadRequest, "scopes must be any of "+strings.Join(apiTokenScopes, ", "))
+		}
+	}
+	scopes := slices.Clone(req.Scopes)
+	slices.Sort(scopes)
+	scopes = slices.Compact(scopes)
+	if req.ExpiresInSeconds < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "expires_in_seconds must not be negative")
+	}
+
+	token, err := generateAPIToken()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate API token: "+err.Error())
+	}
+
+	now := time.Now().Unix()
+	tokenModel := APITokenModel{
+		UserID:    userID,
+		Name:      name,
+		TokenHash: hashAPIToken(token),
+		Scopes:    strings.Join(scopes, ","),
+		CreatedAt: now,
+	}
+	if req.ExpiresInSeconds > 0 {
+		expiresAt := now + req.ExpiresInSeconds
+		tokenModel.ExpiresAt = &expiresAt
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var count int
+	if err := tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM api_tokens WHERE user_id = ? AND (expires_at IS NULL OR expires_at > ?)", userID, now); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count API tokens: "+err.Error())
+	}
+	if count >= maxAPITokensPerUser {
+		return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("can't create more than %d API tokens", maxAPITokensPerUser))
+	}
+
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO api_tokens (user_id, name, token_hash, scopes, created_at, expires_at) VALUES (:user_id, :name, :token_hash, :scopes, :created_at, :expires_at)", &tokenModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert API token: "+err.Error())
+	}
+	tokenID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted API token id: "+err.Error())
+	}
+	tokenModel.ID = tokenID
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, PostAPITokenResponse{
+		APIToken: fillAPITokenResponse(tokenModel),
+		Token:    token,
+	})
+}
+
+// APIトークンの失効
+// DELETE /api/user/me/tokens/:token_id
+func deleteAPITokenHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := getAuthUserID(c)
+
+	tokenID, err := strconv.ParseInt(c.Param("token_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "token_id in path must be integer")
+	}
+
+	rs, err := dbConn.ExecContext(ctx, "DELETE FROM api_tokens WHERE id = ? AND user_id = ?", tokenID, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete API token: "+err.Error())
+	}
+	n, err := rs.RowsAffected()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+	}
+	if n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "API token not found")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func fillAPITokenResponse(tokenModel APITokenModel) APIToken {
+	return APIToken{
+		ID:         tokenModel.ID,
+		Name:       tokenModel.Name,
+		Scopes:     tokenModel.ScopeList(),
+		CreatedAt:  tokenModel.CreatedAt,
+		LastUsedAt: tokenModel.LastUsedAt,
+		ExpiresAt:  tokenModel.ExpiresAt,
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 監査ログの種類
+const (
+	// ユーザ名へのログイン失敗が続いたため、そのユーザ名をロックした
+	auditEventLoginLockoutUsername = "login.lockout.username"
+	// IPアドレスからのログイン失敗が続いたため、そのIPアドレスをロックした
+	auditEventLoginLockoutIP = "login.lockout.ip"
+)
+
+type AuditEventModel struct {
+	ID        int64  `db:"id" json:"id"`
+	EventType string `db:"event_type" json:"event_type"`
+	Username  string `db:"username" json:"username"`
+	IPAddress string `db:"ip_address" json:"ip_address"`
+	Detail    string `db:"detail" json:"detail"`
+	CreatedAt int64  `db:"created_at" json:"created_at"`
+}
+
+func recordAuditEvent(ctx context.Context, eventType, username, ipAddress, detail string, now int64) error {
+	_, err := dbConn.NamedExecContext(ctx, "INSERT INTO audit_events (event_type, username, ip_address, detail, created_at) VALUES (:event_type, :username, :ip_address, :detail, :created_at)", &AuditEventModel{
+		EventType: eventType,
+		Username:  username,
+		IPAddress: ipAddress,
+		Detail:    detail,
+		CreatedAt: now,
+	})
+	return err
+}
+
+// (管理者向け)監査ログの取得
+// GET /api/admin/audit_events
+func getAuditEventsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	pageReq, err := parsePageRequest(c)
+	if err != nil {
+		return err
+	}
+
+	query := "SELECT * FROM audit_events WHERE 1 = 1"
+	args := []any{}
+	if v := c.QueryParam("event_type"); v != "" {
+		query += " AND event_type = ?"
+		args = append(args, v)
+	}
+	if v := c.QueryParam("username"); v != "" {
+		query += " AND username = ?"
+		args = append(args, v)
+	}
+	if cond, condArgs := pageReq.Where("created_at", "id"); cond != "" {
+		query += " AND " + cond
+		args = append(args, condArgs...)
+	}
+	query += pageReq.OrderByAndLimit("created_at", "id")
+
+	var events []AuditEventModel
+	if err := dbConn.SelectContext(ctx, &events, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get audit events: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, newPage(pageReq, events, func(event AuditEventModel) pageCursor {
+		return pageCursor{Key: event.CreatedAt, ID: event.ID}
+	}))
+}
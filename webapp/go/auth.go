@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 認証済みのユーザ情報をecho.Contextに保持するキー
+const authContextKey = "auth"
+
+// 認証済みのユーザ
+type authContext struct {
+	UserID   int64
+	Username string
+	// Cookieのセッションで認証した場合の、サーバ側のセッションID
+	SessionID int64
+	// APIトークンで認証した場合のトークン
+	Token *APITokenModel
+}
+
+// requireAuthで認証したユーザ
+// requireAuthを付けたルートのハンドラでのみ呼び出す
+func getAuth(c echo.Context) *authContext {
+	return c.Get(authContextKey).(*authContext)
+}
+
+// requireAuthで認証したユーザのID
+// requireAuthを付けたルートのハンドラでのみ呼び出す
+func getAuthUserID(c echo.Context) int64 {
+	return getAuth(c).UserID
+}
+
+// Authorization: Bearer ヘッダのAPIトークンで認証する
+// ヘッダがなければ何もせず、requireAuthでCookieのセッションを確認する
+func apiTokenMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		header := c.Request().Header.Get(echo.HeaderAuthorization)
+		if header == "" {
+			return next(c)
+		}
+
+		token, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok || token == "" {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="invalid_request"`)
+			return echo.NewHTTPError(http.StatusUnauthorized, "Authorization header must be a bearer token")
+		}
+
+		ctx := c.Request().Context()
+		now := time.Now().Unix()
+		tokenModel, username, err := findAPIToken(ctx, hashAPIToken(token), now)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get API token: "+err.Error())
+		}
+		if tokenModel == nil {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+			return echo.NewHTTPError(http.StatusUnauthorized, "API token is invalid, expired or revoked")
+		}
+		if err := touchAPIToken(ctx, tokenModel, now); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update API token: "+err.Error())
+		}
+
+		c.Set(authContextKey, &authContext{
+			UserID:   tokenModel.UserID,
+			Username: username,
+			Token:    tokenModel,
+		})
+		return next(c)
+	}
+}
+
+// ログインしているユーザのみが呼び出せるAPIのグループに付ける
+// scopeを指定したグループのAPIは、そのスコープを持つAPIトークンでも呼び出せる
+// scopeが空のグループのAPIは、APIトークンでは呼び出せない
+func requireAuth(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			// APIトークンはapiTokenMiddlewareで確認済み
+			if auth, ok := c.Get(authContextKey).(*authContext); ok && auth.Token != nil {
+				if scope == "" {
+					return echo.NewHTTPError(http.StatusForbidden, "this API does not accept API tokens")
+				}
+				if !slices.Contains(auth.Token.ScopeList(), scope) {
+					c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="insufficient_scope", scope="`+scope+`"`)
+					return echo.NewHTTPError(http.StatusForbidden, "API token does not have the "+scope+" scope")
+				}
+				return next(c)
+			}
+
+			if err := verifyUserSession(c); err != nil {
+				return err
+			}
+			return next(c)
+		}
+	}
+}
+
+// 管理者のみが呼び出せるAPIのグループに、requireAuthの後に付ける
+// 管理者は環境変数 ISUCON13_ADMIN_USERNAMES にカンマ区切りで指定する
+func requireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !slices.Contains(adminUsernames, getAuth(c).Username) {
+			return echo.NewHTTPError(http.StatusForbidden, "admin privilege is required")
+		}
+		return next(c)
+	}
+}
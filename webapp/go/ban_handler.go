@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// BANの範囲
+const (
+	// その配信のみ
+	banScopeLivestream = "livestream"
+	// 配信者のすべての配信
+	banScopeChannel = "channel"
+)
+
+const (
+	maxBanReasonLength = 255
+	// タイムアウトの最長期間
+	maxBanDurationSeconds = 365 * 24 * 60 * 60
+)
+
+type LivestreamBanModel struct {
+	ID         int64 `db:"id"`
+	StreamerID int64 `db:"streamer_id"`
+	// channelスコープならNULL
+	LivestreamID *int64 `db:"livestream_id"`
+	UserID       int64  `db:"user_id"`
+	Reason       string `db:"reason"`
+	CreatedBy    int64  `db:"created_by"`
+	// 無期限ならNULL
+	ExpiresAt *int64 `db:"expires_at"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+type LivestreamBan struct {
+	ID           int64  `json:"id"`
+	User         User   `json:"user"`
+	Scope        string `json:"scope"`
+	LivestreamID *int64 `json:"livestream_id,omitempty"`
+	Reason       string `json:"reason"`
+	// 無期限ならnull
+	ExpiresAt *int64 `json:"expires_at"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type PostLivestreamBanRequest struct {
+	Username string `json:"username"`
+	// 0なら無期限のBAN、それ以外はこの秒数のタイムアウト
+	DurationSeconds int64  `json:"duration_seconds"`
+	Reason          string `json:"reason"`
+	// livestream | channel (省略時はlivestream)
+	Scope string `json:"scope"`
+}
+
+func (m LivestreamBanModel) Scope() string {
+	if m.LivestreamID == nil {
+		return banScopeChannel
+	}
+	return banScopeLivestream
+}
+
+// ユーザをBANする
+// 同じ範囲のBANがすでにあれば置き換える
+func banUser(ctx context.Context, tx *sqlx.Tx, banModel *LivestreamBanModel) error {
+	query := "DELETE FROM livestream_bans WHERE streamer_id = ? AND user_id = ? AND livestream_id IS NULL"
+	args := []any{banModel.StreamerID, banModel.UserID}
+	if banModel.LivestreamID != nil {
+		query = "DELETE FROM livestream_bans WHERE streamer_id = ? AND user_id = ? AND livestream_id = ?"
+		args = append(args, *banModel.LivestreamID)
+	}
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return err
+	}
+
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_bans (streamer_id, livestream_id, user_id, reason, created_by, expires_at, created_at) VALUES (:streamer_id, :livestream_id, :user_id, :reason, :created_by, :expires_at, :created_at)", banModel)
+	if err != nil {
+		return err
+	}
+	banID, err := rs.LastInsertId()
+	if err != nil {
+		return err
+	}
+	banModel.ID = banID
+	return nil
+}
+
+// 配信に対して有効なBANを1つ返す。無期限のもの、期限の遅いものを優先する
+func findActiveBan(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, userID, now int64) (*LivestreamBanModel, error) {
+	var banModels []LivestreamBanModel
+	if err := tx.SelectContext(ctx, &banModels, "SELECT * FROM livestream_bans WHERE user_id = ? AND streamer_id = ?", userID, livestreamModel.UserID); err != nil {
+		return nil, err
+	}
+	return selectActiveBan(banModels, livestreamModel.ID, now), nil
+}
+
+// 配信者のBANのうち、配信に及んでいて期限の過ぎていないものを選ぶ
+// 期限の時刻ちょうどからBANは無効になる
+func selectActiveBan(banModels []LivestreamBanModel, livestreamID, now int64) *LivestreamBanModel {
+	var active *LivestreamBanModel
+	for i := range banModels {
+		banModel := &banModels[i]
+		if banModel.LivestreamID != nil && *banModel.LivestreamID != livestreamID {
+			continue
+		}
+		if banModel.ExpiresAt != nil && *banModel.ExpiresAt <= now {
+			continue
+		}
+		if active == nil || (active.ExpiresAt != nil && (banModel.ExpiresAt == nil || *banModel.ExpiresAt > *active.ExpiresAt)) {
+			active = banModel
+		}
+	}
+	return active
+}
+
+// BANされているユーザなら403を返す
+// 返すエラーはecho.NewHTTPErrorなのでそのまま出力してよい
+func checkNotBanned(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, userID int64) error {
+	banModel, err := findActiveBan(ctx, tx, livestreamModel, userID, time.Now().Unix())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get bans: "+err.Error())
+	}
+	if banModel == nil {
+		return nil
+	}
+	if banModel.ExpiresAt != nil {
+		return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("you are timed out from this livestream until %d", *banModel.ExpiresAt))
+	}
+	return echo.NewHTTPError(http.StatusForbidden, "you are banned from this livestream")
+}
+
+// (配信者向け)ユーザのBAN・タイムアウト
+// POST /api/livestream/:livestream_id/bans
+func postLivestreamBanHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	userID := getAuthUserID(c)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var req *PostLivestreamBanRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "request body must be a json object")
+	}
+	if req.Scope == "" {
+		req.Scope = banScopeLivestream
+	}
+	if req.Scope != banScopeLivestream && req.Scope != banScopeChannel {
+		return echo.NewHTTPError(http.StatusBadRequest, "scope must be livestream or channel")
+	}
+	if req.DurationSeconds < 0 || req.DurationSeconds > maxBanDurationSeconds {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("duration_seconds must be between 0 and %d", maxBanDurationSeconds))
+	}
+	if utf8.RuneCountInString(req.Reason) > maxBanReasonLength {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("reason must be at most %d characters", maxBanReasonLength))
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := getModeratableLivestream(ctx, tx, int64(livestreamID), userID)
+	if err != nil {
+		return err
+	}
+	// 配信者のすべての配信に及ぶBANは配信者本人のみ
+	if req.Scope == banScopeChannel && livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "only the streamer can ban users from the channel")
+	}
+
+	var targetModel UserModel
+	if err := tx.GetContext(ctx, &targetModel, "SELECT * FROM users WHERE name = ?", req.Username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusBadRequest, "user not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	if targetModel.ID == livestreamModel.UserID || targetModel.ID == userID {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't ban the streamer or yourself")
+	}
+
+	now := time.Now().Unix()
+	banModel := LivestreamBanModel{
+		StreamerID: livestreamModel.UserID,
+		UserID:     targetModel.ID,
+		Reason:     req.Reason,
+		CreatedBy:  userID,
+		CreatedAt:  now,
+	}
+	if req.Scope == banScopeLivestream {
+		banModel.LivestreamID = &livestreamModel.ID
+	}
+	if req.DurationSeconds > 0 {
+		expiresAt := now + req.DurationSeconds
+		banModel.ExpiresAt = &expiresAt
+	}
+	if err := banUser(ctx, tx, &banModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert ban: "+err.Error())
+	}
+
+	ban, err := fillLivestreamBanResponse(ctx, tx, banModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill ban: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, ban)
+}
+
+// (配信者向け)配信に対して有効なBANの一覧
+// 配信者のすべての配信に及ぶBANも含む
+// GET /api/livestream/:livestream_id/bans
+func getLivestreamBansHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := getAuthUserID(c)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	pageReq, err := parsePageRequest(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := getModeratableLivestream(ctx, tx, int64(livestreamID), userID)
+	if err != nil {
+		return err
+	}
+
+	query := "SELECT * FROM livestream_bans WHERE streamer_id = ? AND (livestream_id IS NULL OR livestream_id = ?) AND (expires_at IS NULL OR expires_at > ?)"
+	args := []any{livestreamModel.UserID, livestreamModel.ID, time.Now().Unix()}
+	if cond, condArgs := pageReq.Where("created_at", "id"); cond != "" {
+		query += " AND " + cond
+		args = append(args, condArgs...)
+	}
+	query += pageReq.OrderByAndLimit("created_at", "id")
+
+	var banModels []LivestreamBanModel
+	if err := tx.SelectContext(ctx, &banModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get bans: "+err.Error())
+	}
+
+	bans := make([]LivestreamBan, len(banModels))
+	for i := range banModels {
+		ban, err := fillLivestreamBanResponse(ctx, tx, banModels[i])
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill ban: "+err.Error())
+		}
+		bans[i] = ban
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, newPage(pageReq, bans, func(ban LivestreamBan) pageCursor {
+		return pageCursor{Key: ban.CreatedAt, ID: ban.ID}
+	}))
+}
+
+// (配信者向け)BANの解除
+// DELETE /api/livestream/:livestream_id/bans/:ban_id
+func deleteLivestreamBanHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := getAuthUserID(c)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	banID, err := strconv.Atoi(c.Param("ban_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "ban_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := getModeratableLivestream(ctx, tx, int64(livestreamID), userID)
+	if err != nil {
+		return err
+	}
+
+	var banModel LivestreamBanModel
+	if err := tx.GetContext(ctx, &banModel, "SELECT * FROM livestream_bans WHERE id = ? AND streamer_id = ? AND (livestream_id IS NULL OR livestream_id = ?) FOR UPDATE", banID, livestreamModel.UserID, livestreamModel.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "ban not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get ban: "+err.Error())
+	}
+	if banModel.Scope() == banScopeChannel && livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "only the streamer can unban users from the channel")
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_bans WHERE id = ?", banModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete ban: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func fillLivestreamBanResponse(ctx context.Context, tx *sqlx.Tx, banModel LivestreamBanModel) (LivestreamBan, error) {
+	var userModel UserModel
+	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", banModel.UserID); err != nil {
+		return LivestreamBan{}, err
+	}
+	user, err := fillUserResponse(ctx, tx, userModel)
+	if err != nil {
+		return LivestreamBan{}, err
+	}
+
+	return LivestreamBan{
+		ID:           banModel.ID,
+		User:         user,
+		Scope:        banModel.Scope(),
+		LivestreamID: banModel.LivestreamID,
+		Reason:       banModel.Reason,
+		ExpiresAt:    banModel.ExpiresAt,
+		CreatedAt:    banModel.CreatedAt,
+	}, nil
+}
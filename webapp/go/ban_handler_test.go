@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSelectActiveBan(t *testing.T) {
+	const (
+		now          = int64(1700000000)
+		livestreamID = int64(10)
+	)
+	ptr := func(v int64) *int64 { return &v }
+	ban := func(id int64, livestreamID, expiresAt *int64) LivestreamBanModel {
+		return LivestreamBanModel{ID: id, LivestreamID: livestreamID, ExpiresAt: expiresAt}
+	}
+
+	tests := []struct {
+		name   string
+		bans   []LivestreamBanModel
+		wantID int64
+	}{
+		{name: "BANがない", bans: nil},
+		{name: "配信のBAN", bans: []LivestreamBanModel{ban(1, ptr(livestreamID), nil)}, wantID: 1},
+		{name: "他の配信のBANは及ばない", bans: []LivestreamBanModel{ban(1, ptr(livestreamID+1), nil)}},
+		{name: "チャンネルのBANはすべての配信に及ぶ", bans: []LivestreamBanModel{ban(1, nil, nil)}, wantID: 1},
+		{name: "期限の過ぎたタイムアウトは無視する", bans: []LivestreamBanModel{ban(1, ptr(livestreamID), ptr(now-1))}},
+		{name: "期限の時刻ちょうどで無効になる", bans: []LivestreamBanModel{ban(1, nil, ptr(now))}},
+		{name: "期限前のタイムアウト", bans: []LivestreamBanModel{ban(1, nil, ptr(now+1))}, wantID: 1},
+		{
+			name:   "無期限のBANをタイムアウトより優先する",
+			bans:   []LivestreamBanModel{ban(1, ptr(livestreamID), ptr(now+3600)), ban(2, nil, nil)},
+			wantID: 2,
+		},
+		{
+			name:   "期限の遅いタイムアウトを優先する",
+			bans:   []LivestreamBanModel{ban(1, nil, ptr(now+60)), ban(2, ptr(livestreamID), ptr(now+3600)), ban(3, nil, ptr(now+600))},
+			wantID: 2,
+		},
+		{
+			name:   "期限の過ぎたものは期限が遅くても選ばない",
+			bans:   []LivestreamBanModel{ban(1, nil, ptr(now-1)), ban(2, ptr(livestreamID), ptr(now+60))},
+			wantID: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := selectActiveBan(tt.bans, livestreamID, now)
+			if tt.wantID == 0 {
+				if got != nil {
+					t.Fatalf("selectActiveBan = %+v, want nil", got)
+				}
+				return
+			}
+			if got == nil || got.ID != tt.wantID {
+				t.Fatalf("selectActiveBan = %+v, want ban %d", got, tt.wantID)
+			}
+		})
+	}
+}
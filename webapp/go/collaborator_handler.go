@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	collaboratorStatusPending  = "pending"
+	collaboratorStatusAccepted = "accepted"
+	collaboratorStatusDeclined = "declined"
+)
+
+type LivestreamCollaboratorModel struct {
+	ID           int64  `db:"id"`
+	LivestreamID int64  `db:"livestream_id"`
+	UserID       int64  `db:"user_id"`
+	Status       string `db:"status"`
+	CreatedAt    int64  `db:"created_at"`
+}
+
+type LivestreamCollaborator struct {
+	ID           int64  `json:"id"`
+	LivestreamID int64  `json:"livestream_id"`
+	User         User   `json:"user"`
+	Status       string `json:"status"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+type CollaborationInvitation struct {
+	ID         int64      `json:"id"`
+	Livestream Livestream `json:"livestream"`
+	Status     string     `json:"status"`
+	CreatedAt  int64      `json:"created_at"`
+}
+
+type PostCollaboratorRequest struct {
+	Username string `json:"username"`
+}
+
+// (配信者向け)コラボレーターの一覧
+// GET /api/livestream/:livestream_id/collaborators
+func getCollaboratorsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := getAuthUserID(c)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't get other streamer's collaborators")
+	}
+
+	var collaboratorModels []LivestreamCollaboratorModel
+	if err := tx.SelectContext(ctx, &collaboratorModels, "SELECT * FROM livestream_collaborators WHERE livestream_id = ? ORDER BY id", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get collaborators: "+err.Error())
+	}
+
+	collaborators := make([]LivestreamCollaborator, len(collaboratorModels))
+	for i := range collaboratorModels {
+		collaborator, err := fillLivestreamCollaboratorResponse(ctx, tx, collaboratorModels[i])
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill collaborator: "+err.Error())
+		}
+		collaborators[i] = collaborator
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, collaborators)
+}
+
+// (配信者向け)コラボレーターの招待
+// POST /api/livestream/:livestream_id/collaborators
+func postCollaboratorHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	userID := getAuthUserID(c)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var req *PostCollaboratorRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "request body must be a json object")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := getOwnedLivestreamForUpdate(ctx, tx, int64(livestreamID), userID)
+	if err != nil {
+		return err
+	}
+
+	if err := inviteCollaborators(ctx, tx, livestreamModel, []string{req.Username}); err != nil {
+		return err
+	}
+
+	var collaboratorModel LivestreamCollaboratorModel
+	if err := tx.GetContext(ctx, &collaboratorModel, "SELECT lc.* FROM livestream_collaborators lc INNER JOIN users u ON u.id = lc.user_id WHERE lc.livestream_id = ? AND u.name = ?", livestreamID, req.Username); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get collaborator: "+err.Error())
+	}
+	collaborator, err := fillLivestreamCollaboratorResponse(ctx, tx, collaboratorModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill collaborator: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, collaborator)
+}
+
+// 自分宛てのコラボ招待の一覧
+// GET /api/user/me/collaborations
+func getMyCollaborationsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := getAuthUserID(c)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	query := "SELECT * FROM livestream_collaborators WHERE user_id = ?"
+	args := []any{userID}
+	if status := c.QueryParam("status"); status != "" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY id DESC"
+
+	var collaboratorModels []LivestreamCollaboratorModel
+	if err := tx.SelectContext(ctx, &collaboratorModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get collaborations: "+err.Error())
+	}
+
+	invitations := make([]CollaborationInvitation, len(collaboratorModels))
+	for i := range collaboratorModels {
+		var livestreamModel LivestreamModel
+		if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", collaboratorModels[i].LivestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+		livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		}
+		invitations[i] = CollaborationInvitation{
+			ID:         collaboratorModels[i].ID,
+			Livestream: livestream,
+			Status:     collaboratorModels[i].Status,
+			CreatedAt:  collaboratorModels[i].CreatedAt,
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, invitations)
+}
+
+// コラボ招待の承諾
+// POST /api/livestream/:livestream_id/collaborators/accept
+func acceptCollaborationHandler(c echo.Context) error {
+	return respondCollaboration(c, collaboratorStatusAccepted)
+}
+
+// コラボ招待の辞退
+// POST /api/livestream/:livestream_id/collaborators/decline
+func declineCollaborationHandler(c echo.Context) error {
+	return respondCollaboration(c, collaboratorStatusDeclined)
+}
+
+func respondCollaboration(c echo.Context, status string) error {
+	ctx := c.Request().Context()
+
+	userID := getAuthUserID(c)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var collaboratorModel LivestreamCollaboratorModel
+	if err := tx.GetContext(ctx, &collaboratorModel, "SELECT * FROM livestream_collaborators WHERE livestream_id = ? AND user_id = ? FOR UPDATE", livestreamID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "collaboration invitation not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get collaboration invitation: "+err.Error())
+	}
+	if collaboratorModel.Status != collaboratorStatusPending {
+		return echo.NewHTTPError(http.StatusConflict, "collaboration invitation is already "+collaboratorModel.Status)
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE livestream_collaborators SET status = ? WHERE id = ?", status, collaboratorModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update collaboration invitation: "+err.Error())
+	}
+	collaboratorModel.Status = status
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	collaborator, err := fillLivestreamCollaboratorResponse(ctx, tx, collaboratorModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill collaborator: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	if status == collaboratorStatusAccepted {
+		invalidateLivestreamCaches(livestreamModel)
+	}
+
+	return c.JSON(http.StatusOK, collaborator)
+}
+
+// ユーザ名で指定されたユーザをコラボレーターとして招待する
+// 返すエラーはecho.NewHTTPErrorなのでそのまま出力してよい
+func inviteCollaborators(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, usernames []string) error {
+	now := time.Now().Unix()
+	for _, username := range usernames {
+		var userModel UserModel
+		if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE name = ?", username); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("collaborator %s not found", username))
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+		}
+		if userModel.ID == livestreamModel.UserID {
+			return echo.NewHTTPError(http.StatusBadRequest, "a streamer can't invite themselves as a collaborator")
+		}
+
+		var exists int
+		if err := tx.GetContext(ctx, &exists, "SELECT COUNT(*) FROM livestream_collaborators WHERE livestream_id = ? AND user_id = ?", livestreamModel.ID, userModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get collaborator: "+err.Error())
+		}
+		if exists > 0 {
+			return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("%s is already invited", username))
+		}
+
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_collaborators (livestream_id, user_id, status, created_at) VALUES (:livestream_id, :user_id, :status, :created_at)", &LivestreamCollaboratorModel{
+			LivestreamID: livestreamModel.ID,
+			UserID:       userModel.ID,
+			Status:       collaboratorStatusPending,
+			CreatedAt:    now,
+		}); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert collaborator: "+err.Error())
+		}
+	}
+	return nil
+}
+
+// 配信者本人か、招待を承諾したコラボレーターであればモデレーションできる
+func canModerateLivestream(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, userID int64) (bool, error) {
+	if livestreamModel.UserID == userID {
+		return true, nil
+	}
+
+	var count int
+	if err := tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM livestream_collaborators WHERE livestream_id = ? AND user_id = ? AND status = ?", livestreamModel.ID, userID, collaboratorStatusAccepted); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// 招待を承諾したコラボレーターの一覧
+func getLivestreamCollaborators(ctx context.Context, tx *sqlx.Tx, livestreamID int64) ([]User, error) {
+	var userModels []UserModel
+	if err := tx.SelectContext(ctx, &userModels, "SELECT users.* FROM livestream_collaborators INNER JOIN users ON users.id = livestream_collaborators.user_id WHERE livestream_collaborators.livestream_id = ? AND livestream_collaborators.status = ? ORDER BY livestream_collaborators.id", livestreamID, collaboratorStatusAccepted); err != nil {
+		return nil, err
+	}
+
+	collaborators := make([]User, len(userModels))
+	for i := range userModels {
+		user, err := fillUserResponse(ctx, tx, userModels[i])
+		if err != nil {
+			return nil, err
+		}
+		collaborators[i] = user
+	}
+	return collaborators, nil
+}
+
+func fillLivestreamCollaboratorResponse(ctx context.Context, tx *sqlx.Tx, collaboratorModel LivestreamCollaboratorModel) (LivestreamCollaborator, error) {
+	userModel := UserModel{}
+	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", collaboratorModel.UserID); err != nil {
+		return LivestreamCollaborator{}, err
+	}
+	user, err := fillUserResponse(ctx, tx, userModel)
+	if err != nil {
+		return LivestreamCollaborator{}, err
+	}
+
+	return LivestreamCollaborator{
+		ID:           collaboratorModel.ID,
+		LivestreamID: collaboratorModel.LivestreamID,
+		User:         user,
+		Status:       collaboratorModel.Status,
+		CreatedAt:    collaboratorModel.CreatedAt,
+	}, nil
+}
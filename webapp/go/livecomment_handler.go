@@ -10,14 +10,15 @@ import (
 	"net/http"
 	"os"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
-	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
 
+// SSE接続を維持するためのコメント行の送信間隔
+const livecommentStreamHeartbeatInterval = 15 * time.Second
+
 type PostLivecommentRequest struct {
 	Comment string `json:"comment"`
 	Tip     int64  `json:"tip"`
@@ -30,6 +31,10 @@ type LivecommentModel struct {
 	Comment      string `db:"comment"`
 	Tip          int64  `db:"tip"`
 	CreatedAt    int64  `db:"created_at"`
+	// 非表示にされたライブコメントはタイムラインに出さないが、統計には含める
+	HiddenAt     *int64  `db:"hidden_at"`
+	HiddenReason *string `db:"hidden_reason"`
+	HiddenBy     *int64  `db:"hidden_by"`
 }
 
 type Livecomment struct {
@@ -45,19 +50,26 @@ type LivecommentReport struct {
 	ID          int64       `json:"id"`
 	Reporter    User        `json:"reporter"`
 	Livecomment Livecomment `json:"livecomment"`
+	Status      string      `json:"status"`
 	CreatedAt   int64       `json:"created_at"`
+	ResolvedAt  *int64      `json:"resolved_at,omitempty"`
 }
 
 type LivecommentReportModel struct {
-	ID            int64 `db:"id"`
-	UserID        int64 `db:"user_id"`
-	LivestreamID  int64 `db:"livestream_id"`
-	LivecommentID int64 `db:"livecomment_id"`
-	CreatedAt     int64 `db:"created_at"`
+	ID            int64  `db:"id"`
+	UserID        int64  `db:"user_id"`
+	LivestreamID  int64  `db:"livestream_id"`
+	LivecommentID int64  `db:"livecomment_id"`
+	Status        string `db:"status"`
+	CreatedAt     int64  `db:"created_at"`
+	ResolvedAt    *int64 `db:"resolved_at"`
+	ResolvedBy    *int64 `db:"resolved_by"`
 }
 
 type ModerateRequest struct {
 	NGWord string `json:"ng_word"`
+	// literal | whole_word | regex | wildcard (省略時はliteral)
+	MatchType string `json:"match_type"`
 }
 
 type NGWord struct {
@@ -65,27 +77,34 @@ type NGWord struct {
 	UserID       int64  `json:"user_id" db:"user_id"`
 	LivestreamID int64  `json:"livestream_id" db:"livestream_id"`
 	Word         string `json:"word" db:"word"`
-	CreatedAt    int64  `json:"created_at" db:"created_at"`
+	MatchType    string `json:"match_type" db:"match_type"`
+	// livestream | channel | global | shared
+	Scope string `json:"scope" db:"scope"`
+	// 共有リストのNGワード、または共有リストから取り込んだNGワードのリスト
+	ListID    *int64 `json:"list_id,omitempty" db:"list_id"`
+	CreatedAt int64  `json:"created_at" db:"created_at"`
 }
 
 func getLivecommentsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
-		return err
-	}
-
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
-	v, ok := LivecommentCache.Get(fmt.Sprintf("%d", livestreamID))
-	if ok {
-		livecomments, ok := v.([]Livestream)
+	pageReq, err := parsePageRequest(c)
+	if err != nil {
+		return err
+	}
+
+	if pageReq.IsFirstPage() {
+		v, ok := LivecommentCache.Get(fmt.Sprintf("%d", livestreamID))
 		if ok {
-			return c.JSON(http.StatusOK, livecomments)
+			page, ok := v.(Page[Livecomment])
+			if ok {
+				return c.JSON(http.StatusOK, refreshLivecommentPageStatus(page, time.Now().Unix()))
+			}
 		}
 	}
 
@@ -99,7 +118,7 @@ func getLivecommentsHandler(c echo.Context) error {
 	tags := make([]Tag, 0)
 	err = tx.SelectContext(ctx, &tags, query, livestreamID)
 	if errors.Is(err, sql.ErrNoRows) {
-		return c.JSON(http.StatusOK, []*Livecomment{})
+		return c.JSON(http.StatusOK, emptyPage[Livecomment]())
 	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
@@ -124,6 +143,8 @@ func getLivecommentsHandler(c echo.Context) error {
 		LiveStreamThumbnailUrl string `db:"live_stream_thumbnail_url"`
 		LiveStreamStartAt      int64  `db:"live_stream_start_at"`
 		LiveStreamEndAt        int64  `db:"live_stream_end_at"`
+		LiveStreamWentLiveAt   *int64 `db:"live_stream_went_live_at"`
+		LiveStreamEndedAt      *int64 `db:"live_stream_ended_at"`
 	}
 
 	query = "SELECT " +
@@ -140,7 +161,9 @@ func getLivecommentsHandler(c echo.Context) error {
 		"livestreams.playlist_url as live_stream_playlist_url," +
 		"livestreams.thumbnail_url as live_stream_thumbnail_url," +
 		"livestreams.start_at as live_stream_start_at," +
-		"livestreams.end_at as live_stream_end_at " +
+		"livestreams.end_at as live_stream_end_at," +
+		"livestreams.went_live_at as live_stream_went_live_at," +
+		"livestreams.ended_at as live_stream_ended_at " +
 		"FROM livestreams " +
 		"INNER JOIN users ON users.id = livestreams.user_id " +
 		"LEFT JOIN icons ON icons.user_id = users.id " +
@@ -152,13 +175,13 @@ func getLivecommentsHandler(c echo.Context) error {
 	var livestreamModel []LivestreamA
 	err = tx.SelectContext(ctx, &livestreamModel, query, livestreamID)
 	if errors.Is(err, sql.ErrNoRows) {
-		return c.JSON(http.StatusOK, []*Livecomment{})
+		return c.JSON(http.StatusOK, emptyPage[Livecomment]())
 	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
 	if len(livestreamModel) == 0 {
-		return c.JSON(http.StatusOK, []*Livecomment{})
+		return c.JSON(http.StatusOK, emptyPage[Livecomment]())
 	}
 
 	hash := livestreamModel[0].OwnerImageHash.String
@@ -170,6 +193,11 @@ func getLivecommentsHandler(c echo.Context) error {
 		hash = fmt.Sprintf("%x", sha256.Sum256(file))
 	}
 
+	collaborators, err := getLivestreamCollaborators(ctx, tx, livestreamModel[0].LiveStreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get collaborators: "+err.Error())
+	}
+
 	livestream := Livestream{
 		ID: livestreamModel[0].LiveStreamID,
 		Owner: User{
@@ -183,13 +211,17 @@ func getLivecommentsHandler(c echo.Context) error {
 			},
 			IconHash: hash,
 		},
-		Title:        livestreamModel[0].LiveStreamTitle,
-		Description:  livestreamModel[0].LiveStreamDescription,
-		PlaylistUrl:  livestreamModel[0].LiveStreamPlaylistUrl,
-		ThumbnailUrl: livestreamModel[0].LiveStreamThumbnailUrl,
-		Tags:         tags,
-		StartAt:      livestreamModel[0].LiveStreamStartAt,
-		EndAt:        livestreamModel[0].LiveStreamEndAt,
+		Title:         livestreamModel[0].LiveStreamTitle,
+		Description:   livestreamModel[0].LiveStreamDescription,
+		PlaylistUrl:   livestreamModel[0].LiveStreamPlaylistUrl,
+		ThumbnailUrl:  livestreamModel[0].LiveStreamThumbnailUrl,
+		Tags:          tags,
+		StartAt:       livestreamModel[0].LiveStreamStartAt,
+		EndAt:         livestreamModel[0].LiveStreamEndAt,
+		Status:        livestreamStatus(livestreamModel[0].LiveStreamStartAt, livestreamModel[0].LiveStreamEndAt, livestreamModel[0].LiveStreamWentLiveAt, livestreamModel[0].LiveStreamEndedAt, time.Now().Unix()),
+		WentLiveAt:    livestreamModel[0].LiveStreamWentLiveAt,
+		EndedAt:       livestreamModel[0].LiveStreamEndedAt,
+		Collaborators: collaborators,
 	}
 
 	type Response struct {
@@ -230,23 +262,20 @@ func getLivecommentsHandler(c echo.Context) error {
 		" INNER JOIN livestreams ON livestreams.id = livecomments.livestream_id" +
 		" INNER JOIN themes ON themes.user_id = users.id" +
 		" LEFT JOIN icons ON icons.user_id = users.id" +
-		" WHERE livecomments.livestream_id = ?" +
-		" ORDER BY created_at DESC"
-
-	if c.QueryParam("limit") != "" {
-		limit, err := strconv.Atoi(c.QueryParam("limit"))
-		if err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
-		}
-		query += fmt.Sprintf(" LIMIT %d", limit)
+		" WHERE livecomments.livestream_id = ? AND livecomments.hidden_at IS NULL"
+	args := []any{livestreamID}
+	if cond, condArgs := pageReq.Where("livecomments.created_at", "livecomments.id"); cond != "" {
+		query += " AND " + cond
+		args = append(args, condArgs...)
 	}
+	query += pageReq.OrderByAndLimit("livecomments.created_at", "livecomments.id")
 
 	fmt.Println("query: ", query)
 
 	response := []Response{}
-	err = tx.SelectContext(ctx, &response, query, livestreamID)
+	err = tx.SelectContext(ctx, &response, query, args...)
 	if errors.Is(err, sql.ErrNoRows) {
-		return c.JSON(http.StatusOK, []*Livecomment{})
+		return c.JSON(http.StatusOK, emptyPage[Livecomment]())
 	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
@@ -288,22 +317,144 @@ func getLivecommentsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	LivecommentCache.Add(fmt.Sprintf("%d", livestreamID), livecomments)
+	page := newPage(pageReq, livecomments, func(lc Livecomment) pageCursor {
+		return pageCursor{Key: lc.CreatedAt, ID: lc.ID}
+	})
 
-	return c.JSON(http.StatusOK, livecomments)
+	if pageReq.IsFirstPage() {
+		var userIDs []int64
+		for _, livecomment := range livecomments {
+			userIDs = append(userIDs, livecomment.User.ID)
+			userIDs = append(userIDs, livestreamUserIDs(livecomment.Livestream)...)
+		}
+		livecommentCacheUsers.Add(fmt.Sprintf("%d", livestreamID), userIDs)
+		LivecommentCache.Add(fmt.Sprintf("%d", livestreamID), page)
+	}
+
+	return c.JSON(http.StatusOK, page)
 }
 
-func getNgwords(c echo.Context) error {
+// ライブコメントのSSEストリーム
+// GET /api/livestream/:livestream_id/livecomment/stream
+func streamLivecommentsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var lastEventID int64
+	if v := c.Request().Header.Get("Last-Event-ID"); v != "" {
+		lastEventID, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Last-Event-ID header must be integer")
+		}
+	}
+
+	// 再送分の取得中に投稿されたコメントを取りこぼさないよう、先に購読しておく
+	sub := LivestreamEventHub.Subscribe(int64(livestreamID))
+	defer LivestreamEventHub.Unsubscribe(int64(livestreamID), sub)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		} else {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+	}
+
+	// Last-Event-ID 以降のライブコメントを再送する
+	var missedModels []LivecommentModel
+	if lastEventID > 0 {
+		if err := tx.SelectContext(ctx, &missedModels, "SELECT * FROM livecomments WHERE livestream_id = ? AND id > ? AND hidden_at IS NULL ORDER BY id ASC", livestreamID, lastEventID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+		}
+	}
+	missed := make([]Livecomment, len(missedModels))
+	for i := range missedModels {
+		livecomment, err := fillLivecommentResponse(ctx, tx, missedModels[i])
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment: "+err.Error())
+		}
+		missed[i] = livecomment
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set(echo.HeaderConnection, "keep-alive")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	for _, livecomment := range missed {
+		if err := writeLivecommentEvent(res, livecomment); err != nil {
+			return nil
+		}
+		lastEventID = livecomment.ID
+	}
+
+	heartbeat := time.NewTicker(livecommentStreamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-sub.C:
+			if !ok {
+				// 送信が詰まって購読を解除された
+				return nil
+			}
+			if event.Type != livestreamEventLivecommentCreated {
+				continue
+			}
+			livecomment := event.Data.(Livecomment)
+			// 再送済みのものは送らない
+			if livecomment.ID <= lastEventID {
+				continue
+			}
+			if err := writeLivecommentEvent(res, livecomment); err != nil {
+				return nil
+			}
+			lastEventID = livecomment.ID
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(res, ": ping\n\n"); err != nil {
+				return nil
+			}
+			res.Flush()
+		}
+	}
+}
+
+func writeLivecommentEvent(res *echo.Response, livecomment Livecomment) error {
+	data, err := json.Marshal(livecomment)
+	if err != nil {
 		return err
 	}
+	if _, err := fmt.Fprintf(res, "id: %d\nevent: livecomment\ndata: %s\n\n", livecomment.ID, data); err != nil {
+		return err
+	}
+	res.Flush()
+	return nil
+}
+
+func getNgwords(c echo.Context) error {
+	ctx := c.Request().Context()
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := getAuthUserID(c)
 
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
@@ -316,11 +467,30 @@ func getNgwords(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
+	// 配信者とコラボレーターには、配信者のすべての配信、サービス全体に適用されるものも含めて返す
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	canModerate := false
+	if livestreamModel.ID != 0 {
+		canModerate, err = canModerateLivestream(ctx, tx, livestreamModel, userID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to check collaborators: "+err.Error())
+		}
+	}
+
 	var ngWords []*NGWord
-	if err := tx.SelectContext(ctx, &ngWords, "SELECT * FROM ng_words WHERE user_id = ? AND livestream_id = ? ORDER BY created_at DESC", userID, livestreamID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return c.JSON(http.StatusOK, []*NGWord{})
-		} else {
+	if canModerate {
+		ngWords, err = selectLivestreamNGWords(ctx, tx, livestreamModel.UserID, livestreamModel.ID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
+		}
+	} else {
+		// それ以外のユーザには、自分がこの配信に登録したものだけを返す
+		// 自分のチャンネルのNGワードはこの配信には適用されないので含めない
+		ngWords = []*NGWord{}
+		if err := tx.SelectContext(ctx, &ngWords, "SELECT * FROM ng_words WHERE user_id = ? AND livestream_id = ? AND scope = ? ORDER BY created_at DESC", userID, livestreamID, ngWordScopeLivestream); err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
 		}
 	}
@@ -336,25 +506,26 @@ func postLivecommentHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	defer c.Request().Body.Close()
 
-	if err := verifyUserSession(c); err != nil {
-		return err
-	}
-
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 	LivecommentCache.Remove(fmt.Sprintf("%d", livestreamID))
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := getAuthUserID(c)
 
-	var req *PostLivecommentRequest
+	// nullが送られてもゼロ値のまま検証し、400を返す
+	var req PostLivecommentRequest
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
+	if err := validatePostLivecommentRequest(&req); err != nil {
+		// ValidationErrorsはerrorResponseHandlerが400として出力する
+		return err
+	}
+
+	// トランザクションより後に変更されたNGワードを見落としたマッチャーをキャッシュしないよう、先に世代を取る
+	ngWordGeneration := currentNGWordMatcherGeneration()
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
@@ -371,32 +542,45 @@ func postLivecommentHandler(c echo.Context) error {
 		}
 	}
 
-	// スパム判定
-	var ngwords []*NGWord
-	if err := tx.SelectContext(ctx, &ngwords, "SELECT id, user_id, livestream_id, word FROM ng_words WHERE user_id = ? AND livestream_id = ?", livestreamModel.UserID, livestreamModel.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
+	// 配信中のみコメントできる
+	if err := checkLivestreamStatus(livestreamModel, livestreamStatusLive); err != nil {
+		return err
 	}
 
-	var hitSpam int
-	for _, ngword := range ngwords {
-		query := `
-		SELECT COUNT(*)
-		FROM
-		(SELECT ? AS text) AS texts
-		INNER JOIN
-		(SELECT CONCAT('%', ?, '%')	AS pattern) AS patterns
-		ON texts.text LIKE patterns.pattern;
-		`
-		if err := tx.GetContext(ctx, &hitSpam, query, req.Comment, ngword.Word); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get hitspam: "+err.Error())
-		}
-		c.Logger().Infof("[hitSpam=%d] comment = %s", hitSpam, req.Comment)
-		if hitSpam >= 1 {
-			return echo.NewHTTPError(http.StatusBadRequest, "このコメントがスパム判定されました")
-		}
+	if err := checkNotBanned(ctx, tx, livestreamModel, userID); err != nil {
+		return err
+	}
+	// トークンはすべてのバケットを確かめてから消費し、コメントを受け付けなかった場合は戻す
+	reservation, err := checkLivecommentRateLimit(ctx, c, tx, livestreamModel, userID, req.Tip)
+	if err != nil {
+		return err
 	}
+	accepted := false
+	defer func() {
+		if !accepted {
+			reservation.Refund()
+		}
+	}()
 
 	now := time.Now().Unix()
+	duplicate, err := isDuplicateLivecomment(ctx, tx, livestreamModel.ID, userID, req.Comment, now)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last livecomment: "+err.Error())
+	}
+	if duplicate {
+		return ValidationErrors{{Field: "comment", Code: validationCodeDuplicate, Message: "the same comment was posted just before"}}
+	}
+
+	// スパム判定
+	matcher, err := getNGWordMatcher(ctx, tx, livestreamModel, ngWordGeneration)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
+	}
+	if ngword, ok := matcher.Match(req.Comment); ok {
+		c.Logger().Infof("[hitSpam ng_word_id=%d] comment = %s", ngword.ID, req.Comment)
+		return echo.NewHTTPError(http.StatusBadRequest, "このコメントがスパム判定されました")
+	}
+
 	livecommentModel := LivecommentModel{
 		UserID:       userID,
 		LivestreamID: int64(livestreamID),
@@ -424,6 +608,9 @@ func postLivecommentHandler(c echo.Context) error {
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
+	accepted = true
+
+	LivestreamEventHub.Publish(int64(livestreamID), livestreamEventLivecommentCreated, livecomment)
 
 	return c.JSON(http.StatusCreated, livecomment)
 }
@@ -431,10 +618,6 @@ func postLivecommentHandler(c echo.Context) error {
 func reportLivecommentHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
-		return err
-	}
-
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
@@ -445,10 +628,7 @@ func reportLivecommentHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livecomment_id in path must be integer")
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := getAuthUserID(c)
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
@@ -465,8 +645,9 @@ func reportLivecommentHandler(c echo.Context) error {
 		}
 	}
 
+	// 他の配信のライブコメントは、この配信には存在しないものとして扱う
 	var livecommentModel LivecommentModel
-	if err := tx.GetContext(ctx, &livecommentModel, "SELECT * FROM livecomments WHERE id = ?", livecommentID); err != nil {
+	if err := tx.GetContext(ctx, &livecommentModel, "SELECT * FROM livecomments WHERE id = ? AND livestream_id = ?", livecommentID, livestreamID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusNotFound, "livecomment not found")
 		} else {
@@ -479,18 +660,33 @@ func reportLivecommentHandler(c echo.Context) error {
 		UserID:        int64(userID),
 		LivestreamID:  int64(livestreamID),
 		LivecommentID: int64(livecommentID),
+		Status:        reportStatusOpen,
 		CreatedAt:     now,
 	}
-	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livecomment_reports(user_id, livestream_id, livecomment_id, created_at) VALUES (:user_id, :livestream_id, :livecomment_id, :created_at)", &reportModel)
+	// 同じユーザが同じライブコメントを報告できるのは1度だけ
+	// 同時に報告されても、uniq_livecomment_userで重複した方は挿入されない
+	rs, err := tx.NamedExecContext(ctx, "INSERT IGNORE INTO livecomment_reports(user_id, livestream_id, livecomment_id, status, created_at) VALUES (:user_id, :livestream_id, :livecomment_id, :status, :created_at)", &reportModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livecomment report: "+err.Error())
 	}
+	n, err := rs.RowsAffected()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+	}
+	if n == 0 {
+		return echo.NewHTTPError(http.StatusConflict, "livecomment is already reported")
+	}
 	reportID, err := rs.LastInsertId()
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livecomment report id: "+err.Error())
 	}
 	reportModel.ID = reportID
 
+	hidden, reportCount, err := hideReportedLivecomment(ctx, tx, livestreamModel.ID, livecommentModel.ID, now)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to hide reported livecomment: "+err.Error())
+	}
+
 	report, err := fillLivecommentReportResponse(ctx, tx, reportModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment report: "+err.Error())
@@ -499,6 +695,15 @@ func reportLivecommentHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	if hidden {
+		publishHiddenLivecomments(livestreamModel.ID, []int64{livecommentModel.ID})
+		LivestreamEventHub.Publish(livestreamModel.ID, livestreamEventLivecommentAutoHidden, LivecommentAutoHiddenEvent{
+			LivecommentID: livecommentModel.ID,
+			Reason:        hiddenReasonReportThreshold,
+			ReportCount:   reportCount,
+		})
+	}
+
 	return c.JSON(http.StatusCreated, report)
 }
 
@@ -507,24 +712,23 @@ func moderateHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	defer c.Request().Body.Close()
 
-	if err := verifyUserSession(c); err != nil {
-		return err
-	}
-
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := getAuthUserID(c)
 
 	var req *ModerateRequest
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
+	if req.MatchType == "" {
+		req.MatchType = ngWordMatchLiteral
+	}
+	if err := validateNGWordRule(req.MatchType, req.NGWord); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
@@ -532,70 +736,86 @@ func moderateHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	// 配信者自身の配信に対するmoderateなのかを検証
-	var ownedLivestreams []LivestreamModel
-	if err := tx.SelectContext(ctx, &ownedLivestreams, "SELECT * FROM livestreams WHERE id = ? AND user_id = ?", livestreamID, userID); err != nil {
+	// 配信者自身、またはコラボレーターとしての配信に対するmoderateなのかを検証
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusBadRequest, "A streamer can't moderate livestreams that other streamers own")
+		}
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
-	if len(ownedLivestreams) == 0 {
+	canModerate, err := canModerateLivestream(ctx, tx, livestreamModel, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to check collaborators: "+err.Error())
+	}
+	if !canModerate {
 		return echo.NewHTTPError(http.StatusBadRequest, "A streamer can't moderate livestreams that other streamers own")
 	}
 
-	rs, err := tx.NamedExecContext(ctx, "INSERT INTO ng_words(user_id, livestream_id, word, created_at) VALUES (:user_id, :livestream_id, :word, :created_at)", &NGWord{
-		UserID:       int64(userID),
+	// NGワードは配信者のものとして登録する
+	wordID, err := insertNGWord(ctx, tx, &NGWord{
+		UserID:       livestreamModel.UserID,
 		LivestreamID: int64(livestreamID),
 		Word:         req.NGWord,
+		MatchType:    req.MatchType,
+		Scope:        ngWordScopeLivestream,
 		CreatedAt:    time.Now().Unix(),
 	})
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert new NG word: "+err.Error())
 	}
 
-	wordID, err := rs.LastInsertId()
+	// 追加したNGワードを含めてマッチャーを作り直す
+	matcher, err := buildNGWordMatcher(ctx, tx, livestreamModel)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted NG word id: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
 	}
 
-	var ngwords []*NGWord
-	if err := tx.SelectContext(ctx, &ngwords, "SELECT * FROM ng_words WHERE livestream_id = ?", livestreamID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
+	hiddenLivecommentIDs, err := hideLivecommentsMatchingNGWords(ctx, tx, livestreamModel.ID, matcher, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to hide old livecomments that hit spams: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	invalidateNGWordMatcher(livestreamModel.ID)
+	publishHiddenLivecomments(int64(livestreamID), hiddenLivecommentIDs)
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"word_id": wordID,
+	})
+}
+
+// 表示中のライブコメントをNGワードで照合し、一致したNGワードごとに理由を残して非表示にする
+// 非表示にしたライブコメントのIDを返す
+func hideLivecommentsMatchingNGWords(ctx context.Context, tx *sqlx.Tx, livestreamID int64, matcher *ngWordMatcher, actorID int64) ([]int64, error) {
 	var livecomments []*LivecommentModel
-	if err := tx.SelectContext(ctx, &livecomments, "SELECT * FROM livecomments"); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+	if err := tx.SelectContext(ctx, &livecomments, "SELECT * FROM livecomments WHERE livestream_id = ? AND hidden_at IS NULL", livestreamID); err != nil {
+		return nil, err
 	}
 
-	var deleteLiveComentIDs []string
+	hitLivecommentIDs := make(map[int64][]int64)
+	var hitNGWordIDs []int64
 	for _, lc := range livecomments {
-		for _, ng := range ngwords {
-			if strings.Contains(lc.Comment, ng.Word) {
-				deleteLiveComentIDs = append(deleteLiveComentIDs, strconv.FormatInt(lc.ID, 10))
-				break
+		if ngword, ok := matcher.Match(lc.Comment); ok {
+			if _, ok := hitLivecommentIDs[ngword.ID]; !ok {
+				hitNGWordIDs = append(hitNGWordIDs, ngword.ID)
 			}
+			hitLivecommentIDs[ngword.ID] = append(hitLivecommentIDs[ngword.ID], lc.ID)
 		}
 	}
 
-	if len(deleteLiveComentIDs) > 0 {
-		query := `
-		DELETE FROM livecomments
-		WHERE
-		id IN (%s) AND
-		livestream_id = ? 
-		`
-		if _, err := tx.ExecContext(ctx, fmt.Sprintf(query, strings.Join(deleteLiveComentIDs, ",")), livestreamID); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete old livecomments that hit spams: "+err.Error())
+	var hiddenLivecommentIDs []int64
+	for _, ngwordID := range hitNGWordIDs {
+		hiddenIDs, err := hideLivecomments(ctx, tx, livestreamID, hitLivecommentIDs[ngwordID], hiddenReasonNGWord(ngwordID), &actorID)
+		if err != nil {
+			return nil, err
 		}
-
-	}
-
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+		hiddenLivecommentIDs = append(hiddenLivecommentIDs, hiddenIDs...)
 	}
-
-	return c.JSON(http.StatusCreated, map[string]interface{}{
-		"word_id": wordID,
-	})
+	return hiddenLivecommentIDs, nil
 }
 
 func fillLivecommentResponse(ctx context.Context, tx *sqlx.Tx, livecommentModel LivecommentModel) (Livecomment, error) {
@@ -652,7 +872,9 @@ func fillLivecommentReportResponse(ctx context.Context, tx *sqlx.Tx, reportModel
 		ID:          reportModel.ID,
 		Reporter:    reporter,
 		Livecomment: livecomment,
+		Status:      reportModel.Status,
 		CreatedAt:   reportModel.CreatedAt,
+		ResolvedAt:  reportModel.ResolvedAt,
 	}
 	return report, nil
 }
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	maxLivecommentLength = 255
+	maxLivecommentTip    = 100000
+	// 同じユーザが同じコメントを続けて投稿できない期間
+	duplicateLivecommentWindowSeconds = 30
+
+	// カンマ区切りで指定すると、チップはそのいずれかの額に限る
+	livecommentTipTiersEnvKey = "ISUCON13_TIP_TIERS"
+)
+
+// 検証エラーの種類
+const (
+	validationCodeRequired    = "required"
+	validationCodeTooShort    = "too_short"
+	validationCodeTooLong     = "too_long"
+	validationCodeTooWeak     = "too_weak"
+	validationCodeOutOfRange  = "out_of_range"
+	validationCodeInvalidTier = "invalid_tier"
+	validationCodeDuplicate   = "duplicate"
+)
+
+// 許可するチップの額。空ならmaxLivecommentTipまでの任意の額
+var livecommentTipTiers []int64
+
+type ValidationError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// リクエストの検証エラー
+// errorResponseHandlerが400として、各項目をdetailsに入れて返す
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i := range e {
+		messages[i] = e[i].Field + ": " + e[i].Message
+	}
+	return strings.Join(messages, ", ")
+}
+
+func loadLivecommentValidationConfig() error {
+	v, ok := os.LookupEnv(livecommentTipTiersEnvKey)
+	if !ok || v == "" {
+		return nil
+	}
+	for _, s := range strings.Split(v, ",") {
+		tier, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as integers: %+v", livecommentTipTiersEnvKey, err)
+		}
+		if tier < 1 || tier > maxLivecommentTip {
+			return fmt.Errorf("environment variable '%s' must be between 1 and %d", livecommentTipTiersEnvKey, maxLivecommentTip)
+		}
+		livecommentTipTiers = append(livecommentTipTiers, tier)
+	}
+	slices.Sort(livecommentTipTiers)
+	return nil
+}
+
+// 表示を崩す制御文字・双方向テキストの制御文字を取り除く
+func sanitizeLivecomment(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.Is(unicode.Cc, r) || unicode.Is(unicode.Bidi_Control, r) {
+			return -1
+		}
+		return r
+	}, s)
+	return strings.TrimSpace(s)
+}
+
+// ライブコメントの投稿リクエストを検証する
+// 制御文字を取り除いたコメントをreqに書き戻す
+func validatePostLivecommentRequest(req *PostLivecommentRequest) error {
+	if req == nil {
+		return ValidationErrors{{Field: "comment", Code: validationCodeRequired, Message: "comment must not be empty"}}
+	}
+
+	var errs ValidationErrors
+
+	req.Comment = sanitizeLivecomment(req.Comment)
+	if req.Comment == "" {
+		errs = append(errs, ValidationError{Field: "comment", Code: validationCodeRequired, Message: "comment must not be empty"})
+	} else if utf8.RuneCountInString(req.Comment) > maxLivecommentLength {
+		errs = append(errs, ValidationError{Field: "comment", Code: validationCodeTooLong, Message: fmt.Sprintf("comment must be at most %d characters", maxLivecommentLength)})
+	}
+
+	switch {
+	case req.Tip < 0 || req.Tip > maxLivecommentTip:
+		errs = append(errs, ValidationError{Field: "tip", Code: validationCodeOutOfRange, Message: fmt.Sprintf("tip must be between 0 and %d", maxLivecommentTip)})
+	case req.Tip > 0 && len(livecommentTipTiers) > 0 && !slices.Contains(livecommentTipTiers, req.Tip):
+		tiers := make([]string, len(livecommentTipTiers))
+		for i, tier := range livecommentTipTiers {
+			tiers[i] = strconv.FormatInt(tier, 10)
+		}
+		errs = append(errs, ValidationError{Field: "tip", Code: validationCodeInvalidTier, Message: "tip must be one of " + strings.Join(tiers, ", ")})
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// 直前に投稿したものと同じコメントを、短い間隔で続けて投稿しようとしているか
+func isDuplicateLivecomment(ctx context.Context, tx *sqlx.Tx, livestreamID, userID int64, comment string, now int64) (bool, error) {
+	var last LivecommentModel
+	if err := tx.GetContext(ctx, &last, "SELECT * FROM livecomments WHERE user_id = ? AND livestream_id = ? ORDER BY id DESC LIMIT 1", userID, livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	return last.Comment == comment && now-last.CreatedAt < duplicateLivecommentWindowSeconds, nil
+}
@@ -11,7 +11,6 @@ import (
 	"time"
 
 	"github.com/jmoiron/sqlx"
-	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
 
@@ -23,6 +22,10 @@ type ReserveLivestreamRequest struct {
 	ThumbnailUrl string  `json:"thumbnail_url"`
 	StartAt      int64   `json:"start_at"`
 	EndAt        int64   `json:"end_at"`
+	// 指定された場合、StartAt/EndAtを初回として繰り返し予約する
+	Recurrence *RecurrenceRule `json:"recurrence"`
+	// コラボレーターとして招待するユーザ名
+	Collaborators []string `json:"collaborators"`
 }
 
 type LivestreamViewerModel struct {
@@ -40,6 +43,10 @@ type LivestreamModel struct {
 	ThumbnailUrl string `db:"thumbnail_url" json:"thumbnail_url"`
 	StartAt      int64  `db:"start_at" json:"start_at"`
 	EndAt        int64  `db:"end_at" json:"end_at"`
+	SeriesID     *int64 `db:"series_id" json:"series_id"`
+	// 配信者が配信を開始・終了した時刻
+	WentLiveAt *int64 `db:"went_live_at" json:"went_live_at"`
+	EndedAt    *int64 `db:"ended_at" json:"ended_at"`
 }
 
 type Livestream struct {
@@ -52,6 +59,13 @@ type Livestream struct {
 	Tags         []Tag  `json:"tags"`
 	StartAt      int64  `json:"start_at"`
 	EndAt        int64  `json:"end_at"`
+	SeriesID     *int64 `json:"series_id,omitempty"`
+	// scheduled | live | ended | archived
+	Status     string `json:"status"`
+	WentLiveAt *int64 `json:"went_live_at,omitempty"`
+	EndedAt    *int64 `json:"ended_at,omitempty"`
+	// 招待を承諾したコラボレーター
+	Collaborators []User `json:"collaborators"`
 }
 
 type LivestreamTagModel struct {
@@ -60,31 +74,78 @@ type LivestreamTagModel struct {
 	TagID        int64 `db:"tag_id" json:"tag_id"`
 }
 
-type ReservationSlotModel struct {
-	ID      int64 `db:"id" json:"id"`
-	Slot    int64 `db:"slot" json:"slot"`
-	StartAt int64 `db:"start_at" json:"start_at"`
-	EndAt   int64 `db:"end_at" json:"end_at"`
+// 配信予約の変更リクエスト
+// 指定されなかった項目は変更しない
+type UpdateLivestreamRequest struct {
+	Tags         *[]int64 `json:"tags"`
+	Title        *string  `json:"title"`
+	Description  *string  `json:"description"`
+	ThumbnailUrl *string  `json:"thumbnail_url"`
+	StartAt      *int64   `json:"start_at"`
+	EndAt        *int64   `json:"end_at"`
 }
 
 func reserveLivestreamHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	defer c.Request().Body.Close()
 
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
+	userID := getAuthUserID(c)
+
+	var req *ReserveLivestreamRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	if req.Recurrence != nil {
+		return reserveLivestreamSeries(c, userID, req)
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := reserveLivestream(ctx, tx, userID, req, req.StartAt, req.EndAt, nil)
+	if err != nil {
 		return err
 	}
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	LivestreamCache.Remove(fmt.Sprintf("%d", userID))
+	SearchLivestreamCache.Purge()
 
-	var req *ReserveLivestreamRequest
+	livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, livestream)
+}
+
+// 配信予約の変更
+// PATCH /api/livestream/:livestream_id
+func updateLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	userID := getAuthUserID(c)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var req *UpdateLivestreamRequest
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
+	if req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "request body must be a json object")
+	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
@@ -92,96 +153,151 @@ func reserveLivestreamHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	// 2023/11/25 10:00からの１年間の期間内であるかチェック
-	var (
-		termStartAt    = time.Date(2023, 11, 25, 1, 0, 0, 0, time.UTC)
-		termEndAt      = time.Date(2024, 11, 25, 1, 0, 0, 0, time.UTC)
-		reserveStartAt = time.Unix(req.StartAt, 0)
-		reserveEndAt   = time.Unix(req.EndAt, 0)
-	)
-	if (reserveStartAt.Equal(termEndAt) || reserveStartAt.After(termEndAt)) || (reserveEndAt.Equal(termStartAt) || reserveEndAt.Before(termStartAt)) {
-		return echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
+	livestreamModel, err := getOwnedLivestreamForUpdate(ctx, tx, int64(livestreamID), userID)
+	if err != nil {
+		return err
 	}
 
-	// 予約枠をみて、予約が可能か調べる
-	// NOTE: 並列な予約のoverbooking防止にFOR UPDATEが必要
-	var slots []*ReservationSlotModel
-	if err := tx.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? FOR UPDATE", req.StartAt, req.EndAt); err != nil {
-		c.Logger().Warnf("予約枠一覧取得でエラー発生: %+v", err)
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
-	}
-	for _, slot := range slots {
-		var count int
-		if err := tx.GetContext(ctx, &count, "SELECT slot FROM reservation_slots WHERE start_at = ? AND end_at = ?", slot.StartAt, slot.EndAt); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	if req.Title != nil {
+		livestreamModel.Title = *req.Title
+	}
+	if req.Description != nil {
+		livestreamModel.Description = *req.Description
+	}
+	if req.ThumbnailUrl != nil {
+		livestreamModel.ThumbnailUrl = *req.ThumbnailUrl
+	}
+
+	// 日時の変更は予約枠を返却してから取り直す
+	if req.StartAt != nil || req.EndAt != nil {
+		startAt, endAt := livestreamModel.StartAt, livestreamModel.EndAt
+		if req.StartAt != nil {
+			startAt = *req.StartAt
 		}
-		c.Logger().Infof("%d ~ %d予約枠の残数 = %d\n", slot.StartAt, slot.EndAt, slot.Slot)
-		if count < 1 {
-			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", termStartAt.Unix(), termEndAt.Unix(), req.StartAt, req.EndAt))
+		if req.EndAt != nil {
+			endAt = *req.EndAt
 		}
-	}
 
-	var (
-		livestreamModel = &LivestreamModel{
-			UserID:       int64(userID),
-			Title:        req.Title,
-			Description:  req.Description,
-			PlaylistUrl:  req.PlaylistUrl,
-			ThumbnailUrl: req.ThumbnailUrl,
-			StartAt:      req.StartAt,
-			EndAt:        req.EndAt,
+		if startAt != livestreamModel.StartAt || endAt != livestreamModel.EndAt {
+			if livestreamModel.Status(time.Now().Unix()) != livestreamStatusScheduled {
+				return echo.NewHTTPError(http.StatusBadRequest, "can't reschedule a livestream that has already started")
+			}
+			if startAt >= endAt {
+				return echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
+			}
+			term, ok, err := findReservationTerm(ctx, tx, startAt, endAt)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_terms: "+err.Error())
+			}
+			if !ok {
+				return echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
+			}
+
+			if err := releaseReservationSlots(ctx, tx, livestreamModel.StartAt, livestreamModel.EndAt); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to release reservation_slots: "+err.Error())
+			}
+			if err := acquireReservationSlots(ctx, tx, startAt, endAt); err != nil {
+				if errors.Is(err, errReservationSlotUnavailable) {
+					return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", term.StartAt, term.EndAt, startAt, endAt))
+				}
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slots: "+err.Error())
+			}
+
+			livestreamModel.StartAt = startAt
+			livestreamModel.EndAt = endAt
 		}
-	)
+	}
 
-	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ?", req.StartAt, req.EndAt); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
+	if _, err := tx.NamedExecContext(ctx, "UPDATE livestreams SET title = :title, description = :description, thumbnail_url = :thumbnail_url, start_at = :start_at, end_at = :end_at WHERE id = :id", livestreamModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream: "+err.Error())
 	}
 
-	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at)", livestreamModel)
+	if req.Tags != nil {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_tags WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream tags: "+err.Error())
+		}
+		if err := insertLivestreamTags(ctx, tx, livestreamModel.ID, *req.Tags); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error())
+		}
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
 	}
 
-	LivestreamCache.Remove(fmt.Sprintf("%d", userID))
-	SearchLivestreamCache.Purge()
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
 
-	livestreamID, err := rs.LastInsertId()
+	invalidateLivestreamCaches(livestreamModel)
+
+	return c.JSON(http.StatusOK, livestream)
+}
+
+// 配信予約の取り消し
+// DELETE /api/livestream/:livestream_id
+func cancelLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := getAuthUserID(c)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livestream id: "+err.Error())
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
-	livestreamModel.ID = livestreamID
 
-	// タグ追加
-	for _, tagID := range req.Tags {
-		if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (:livestream_id, :tag_id)", &LivestreamTagModel{
-			LivestreamID: livestreamID,
-			TagID:        tagID,
-		}); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error())
-		}
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
+	defer tx.Rollback()
 
-	livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
+	livestreamModel, err := getOwnedLivestreamForUpdate(ctx, tx, int64(livestreamID), userID)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		return err
+	}
+
+	if livestreamModel.Status(time.Now().Unix()) != livestreamStatusScheduled {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't cancel a livestream that has already started")
+	}
+
+	if err := cancelLivestream(ctx, tx, livestreamModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to cancel livestream: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusCreated, livestream)
+	invalidateLivestreamCaches(livestreamModel)
+
+	return c.NoContent(http.StatusNoContent)
 }
 
+// 配信の検索
+// GET /api/livestream/search?q=&tag=&tag_mode=&status=&owner=&sort=
 func searchLivestreamsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	keyTagName := c.QueryParam("tag")
 
-	v, ok := SearchLivestreamCache.Get(keyTagName)
-	if ok {
-		livestreams, ok := v.([]Livestream)
+	params, err := parseLivestreamSearchParams(c)
+	if err != nil {
+		return err
+	}
+
+	pageReq, err := parsePageRequest(c)
+	if err != nil {
+		return err
+	}
+
+	cacheKey := params.CacheKey() + "&" + pageReq.CacheKey()
+	if params.Cacheable() {
+		v, ok := SearchLivestreamCache.Get(cacheKey)
 		if ok {
-			return c.JSON(http.StatusOK, livestreams)
+			page, ok := v.(Page[Livestream])
+			if ok {
+				return c.JSON(http.StatusOK, refreshLivestreamPageStatus(page, time.Now().Unix()))
+			}
 		}
 	}
 
@@ -191,120 +307,126 @@ func searchLivestreamsHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	var livestreamModels []*LivestreamModel
-	if c.QueryParam("tag") != "" {
-		// タグによる取得
-		var tagIDList []int
-		if err := tx.SelectContext(ctx, &tagIDList, "SELECT id FROM tags WHERE name = ?", keyTagName); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
-		}
+	query, args, err := params.buildQuery(pageReq, time.Now().Unix())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to build search query: "+err.Error())
+	}
 
-		query, params, err := sqlx.In("SELECT * FROM livestream_tags WHERE tag_id IN (?) ORDER BY livestream_id DESC", tagIDList)
+	var rows []*livestreamSearchRow
+	if err := tx.SelectContext(ctx, &rows, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+
+	rowPage := newPage(pageReq, rows, params.cursorOf)
+	livestreams := make([]Livestream, len(rowPage.Items))
+	for i := range rowPage.Items {
+		livestream, err := fillLivestreamResponse(ctx, tx, rowPage.Items[i].LivestreamModel)
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
-		}
-		var keyTaggedLivestreams []*LivestreamTagModel
-		if err := tx.SelectContext(ctx, &keyTaggedLivestreams, query, params...); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get keyTaggedLivestreams: "+err.Error())
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
 		}
+		livestreams[i] = livestream
+	}
 
-		for _, keyTaggedLivestream := range keyTaggedLivestreams {
-			ls := LivestreamModel{}
-			if err := tx.GetContext(ctx, &ls, "SELECT * FROM livestreams WHERE id = ?", keyTaggedLivestream.LivestreamID); err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
-			}
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
 
-			livestreamModels = append(livestreamModels, &ls)
-		}
-	} else {
-		// 検索条件なし
-		query := `SELECT * FROM livestreams ORDER BY id DESC`
-		if c.QueryParam("limit") != "" {
-			limit, err := strconv.Atoi(c.QueryParam("limit"))
-			if err != nil {
-				return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
-			}
-			query += fmt.Sprintf(" LIMIT %d", limit)
+	page := Page[Livestream]{
+		Items:      livestreams,
+		NextCursor: rowPage.NextCursor,
+	}
+	if params.Cacheable() {
+		var userIDs []int64
+		for _, livestream := range livestreams {
+			userIDs = append(userIDs, livestreamUserIDs(livestream)...)
 		}
+		searchLivestreamCacheUsers.Add(cacheKey, userIDs)
+		SearchLivestreamCache.Add(cacheKey, page)
+	}
 
-		if err := tx.SelectContext(ctx, &livestreamModels, query); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
-		}
+	return c.JSON(http.StatusOK, page)
+}
+
+func livestreamPageCursor(livestream Livestream) pageCursor {
+	return pageCursor{Key: livestream.ID, ID: livestream.ID}
+}
+
+// ユーザの配信一覧をページングして取得する
+func selectUserLivestreams(ctx context.Context, tx *sqlx.Tx, userID int64, pageReq pageRequest) (Page[Livestream], error) {
+	query := "SELECT * FROM livestreams WHERE user_id = ?"
+	args := []any{userID}
+	if cond, condArgs := pageReq.Where("id", "id"); cond != "" {
+		query += " AND " + cond
+		args = append(args, condArgs...)
 	}
+	query += pageReq.OrderByAndLimit("id", "id")
 
+	var livestreamModels []*LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, query, args...); err != nil {
+		return Page[Livestream]{}, err
+	}
 	livestreams := make([]Livestream, len(livestreamModels))
 	for i := range livestreamModels {
 		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+			return Page[Livestream]{}, err
 		}
 		livestreams[i] = livestream
 	}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
-	}
-
-	SearchLivestreamCache.Add(keyTagName, livestreams)
-
-	return c.JSON(http.StatusOK, livestreams)
+	return newPage(pageReq, livestreams, livestreamPageCursor), nil
 }
 
 func getMyLivestreamsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	if err := verifyUserSession(c); err != nil {
-		return err
-	}
-
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := getAuthUserID(c)
+
+	pageReq, err := parsePageRequest(c)
+	if err != nil {
+		return err
+	}
 
-	v, ok := LivestreamCache.Get(fmt.Sprintf("%d", userID))
-	if ok {
-		livestreams, ok := v.([]*LivestreamModel)
+	if pageReq.IsFirstPage() {
+		v, ok := LivestreamCache.Get(fmt.Sprintf("%d", userID))
 		if ok {
-			return c.JSON(http.StatusOK, livestreams)
+			page, ok := v.(Page[Livestream])
+			if ok {
+				return c.JSON(http.StatusOK, refreshLivestreamPageStatus(page, time.Now().Unix()))
+			}
 		}
 	}
 
-	var livestreamModels []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ?", userID); err != nil {
+	page, err := selectUserLivestreams(ctx, tx, userID, pageReq)
+	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
-	livestreams := make([]Livestream, len(livestreamModels))
-	for i := range livestreamModels {
-		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
-		}
-		livestreams[i] = livestream
-	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	LivestreamCache.Add(fmt.Sprintf("%d", userID), livestreams)
+	if pageReq.IsFirstPage() {
+		LivestreamCache.Add(fmt.Sprintf("%d", userID), page)
+	}
 
-	return c.JSON(http.StatusOK, livestreams)
+	return c.JSON(http.StatusOK, page)
 }
 
 func getUserLivestreamsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	if err := verifyUserSession(c); err != nil {
+	username := c.Param("username")
+
+	pageReq, err := parsePageRequest(c)
+	if err != nil {
 		return err
 	}
 
-	username := c.Param("username")
-
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
@@ -320,38 +442,22 @@ func getUserLivestreamsHandler(c echo.Context) error {
 		}
 	}
 
-	var livestreamModels []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ?", user.ID); err != nil {
+	page, err := selectUserLivestreams(ctx, tx, user.ID, pageReq)
+	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
-	livestreams := make([]Livestream, len(livestreamModels))
-	for i := range livestreamModels {
-		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
-		}
-		livestreams[i] = livestream
-	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, livestreams)
+	return c.JSON(http.StatusOK, page)
 }
 
 // viewerテーブルの廃止
 func enterLivestreamHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
-		return err
-	}
-
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := getAuthUserID(c)
 
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
@@ -364,6 +470,15 @@ func enterLivestreamHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
+	// 終了した配信には入室できない
+	livestreamModel, err := getLivestreamInStatus(ctx, tx, int64(livestreamID), livestreamStatusScheduled, livestreamStatusLive)
+	if err != nil {
+		return err
+	}
+	if err := checkNotBanned(ctx, tx, livestreamModel, userID); err != nil {
+		return err
+	}
+
 	viewer := LivestreamViewerModel{
 		UserID:       int64(userID),
 		LivestreamID: int64(livestreamID),
@@ -374,24 +489,23 @@ func enterLivestreamHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream_view_history: "+err.Error())
 	}
 
+	viewersCount, err := countLivestreamViewers(ctx, tx, int64(livestreamID))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestream viewers: "+err.Error())
+	}
+
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	LivestreamEventHub.Publish(int64(livestreamID), livestreamEventViewersChanged, ViewersChangedEvent{ViewersCount: viewersCount})
+
 	return c.NoContent(http.StatusOK)
 }
 
 func exitLivestreamHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
-		return err
-	}
-
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := getAuthUserID(c)
 
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
@@ -408,20 +522,23 @@ func exitLivestreamHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream_view_history: "+err.Error())
 	}
 
+	viewersCount, err := countLivestreamViewers(ctx, tx, int64(livestreamID))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestream viewers: "+err.Error())
+	}
+
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	LivestreamEventHub.Publish(int64(livestreamID), livestreamEventViewersChanged, ViewersChangedEvent{ViewersCount: viewersCount})
+
 	return c.NoContent(http.StatusOK)
 }
 
 func getLivestreamHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
-		return err
-	}
-
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
@@ -457,15 +574,20 @@ func getLivestreamHandler(c echo.Context) error {
 func getLivecommentReportsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
-		return err
-	}
-
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
+	pageReq, err := parsePageRequest(c)
+	if err != nil {
+		return err
+	}
+	status, err := parseReportStatusQuery(c)
+	if err != nil {
+		return err
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
@@ -474,20 +596,36 @@ func getLivecommentReportsHandler(c echo.Context) error {
 
 	var livestreamModel LivestreamModel
 	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 	}
 
-	// error already check
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already check
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := getAuthUserID(c)
 
-	if livestreamModel.UserID != userID {
+	canModerate, err := canModerateLivestream(ctx, tx, livestreamModel, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to check collaborators: "+err.Error())
+	}
+	if !canModerate {
 		return echo.NewHTTPError(http.StatusForbidden, "can't get other streamer's livecomment reports")
 	}
 
+	query := "SELECT * FROM livecomment_reports WHERE livestream_id = ?"
+	args := []any{livestreamID}
+	if status != "" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	if cond, condArgs := pageReq.Where("created_at", "id"); cond != "" {
+		query += " AND " + cond
+		args = append(args, condArgs...)
+	}
+	query += pageReq.OrderByAndLimit("created_at", "id")
+
 	var reportModels []*LivecommentReportModel
-	if err := tx.SelectContext(ctx, &reportModels, "SELECT * FROM livecomment_reports WHERE livestream_id = ?", livestreamID); err != nil {
+	if err := tx.SelectContext(ctx, &reportModels, query, args...); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment reports: "+err.Error())
 	}
 
@@ -504,7 +642,139 @@ func getLivecommentReportsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, reports)
+	return c.JSON(http.StatusOK, newPage(pageReq, reports, func(r LivecommentReport) pageCursor {
+		return pageCursor{Key: r.CreatedAt, ID: r.ID}
+	}))
+}
+
+// 予約期間と予約枠を検証したうえで配信を予約する
+// 返すエラーはecho.NewHTTPErrorなのでそのまま出力してよい
+func reserveLivestream(ctx context.Context, tx *sqlx.Tx, userID int64, req *ReserveLivestreamRequest, startAt, endAt int64, seriesID *int64) (*LivestreamModel, error) {
+	// 予約を受け付けている期間内であるかチェック
+	term, ok, err := findReservationTerm(ctx, tx, startAt, endAt)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_terms: "+err.Error())
+	}
+	if !ok {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
+	}
+
+	// 予約枠をみて、予約が可能か調べる
+	if err := acquireReservationSlots(ctx, tx, startAt, endAt); err != nil {
+		if errors.Is(err, errReservationSlotUnavailable) {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", term.StartAt, term.EndAt, startAt, endAt))
+		}
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slots: "+err.Error())
+	}
+
+	livestreamModel := &LivestreamModel{
+		UserID:       userID,
+		Title:        req.Title,
+		Description:  req.Description,
+		PlaylistUrl:  req.PlaylistUrl,
+		ThumbnailUrl: req.ThumbnailUrl,
+		StartAt:      startAt,
+		EndAt:        endAt,
+		SeriesID:     seriesID,
+	}
+
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at, series_id) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at, :series_id)", livestreamModel)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream: "+err.Error())
+	}
+
+	livestreamID, err := rs.LastInsertId()
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livestream id: "+err.Error())
+	}
+	livestreamModel.ID = livestreamID
+
+	// タグ追加
+	if err := insertLivestreamTags(ctx, tx, livestreamID, req.Tags); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error())
+	}
+
+	if err := inviteCollaborators(ctx, tx, *livestreamModel, req.Collaborators); err != nil {
+		return nil, err
+	}
+
+	return livestreamModel, nil
+}
+
+// 予約枠を返却し、配信と、配信に紐づくタグ・コラボレーター・モデレーションの設定や記録を削除する
+// 配信者のすべての配信に及ぶNGワードやBANは残す
+func cancelLivestream(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel) error {
+	if err := releaseReservationSlots(ctx, tx, livestreamModel.StartAt, livestreamModel.EndAt); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_tags WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_collaborators WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM ng_words WHERE livestream_id = ? AND scope = ?", livestreamModel.ID, ngWordScopeLivestream); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_bans WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_moderation_settings WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM moderation_logs WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livecomment_reports WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestreams WHERE id = ?", livestreamModel.ID); err != nil {
+		return err
+	}
+	return nil
+}
+
+// 配信者自身の配信を、更新のためにロックして取得する
+// 返すエラーはecho.NewHTTPErrorなのでそのまま出力してよい
+func getOwnedLivestreamForUpdate(ctx context.Context, tx *sqlx.Tx, livestreamID int64, userID int64) (LivestreamModel, error) {
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? FOR UPDATE", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return LivestreamModel{}, echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return LivestreamModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return LivestreamModel{}, echo.NewHTTPError(http.StatusForbidden, "can't modify other streamer's livestream")
+	}
+	return livestreamModel, nil
+}
+
+func insertLivestreamTags(ctx context.Context, tx *sqlx.Tx, livestreamID int64, tagIDs []int64) error {
+	for _, tagID := range tagIDs {
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (:livestream_id, :tag_id)", &LivestreamTagModel{
+			LivestreamID: livestreamID,
+			TagID:        tagID,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 配信の内容を埋め込んでいるキャッシュを破棄する
+func invalidateLivestreamCaches(livestreamModel LivestreamModel) {
+	LivestreamCache.Remove(fmt.Sprintf("%d", livestreamModel.UserID))
+	SearchLivestreamCache.Purge()
+	LivecommentCache.Remove(fmt.Sprintf("%d", livestreamModel.ID))
+}
+
+func countLivestreamViewers(ctx context.Context, tx *sqlx.Tx, livestreamID int64) (int64, error) {
+	var viewersCount int64
+	if err := tx.GetContext(ctx, &viewersCount, "SELECT COUNT(*) FROM livestream_viewers_history WHERE livestream_id = ?", livestreamID); err != nil {
+		return 0, err
+	}
+	return viewersCount, nil
 }
 
 func fillLivestreamResponse(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel) (Livestream, error) {
@@ -522,16 +792,26 @@ func fillLivestreamResponse(ctx context.Context, tx *sqlx.Tx, livestreamModel Li
 		return Livestream{}, err
 	}
 
+	collaborators, err := getLivestreamCollaborators(ctx, tx, livestreamModel.ID)
+	if err != nil {
+		return Livestream{}, err
+	}
+
 	livestream := Livestream{
-		ID:           livestreamModel.ID,
-		Owner:        owner,
-		Title:        livestreamModel.Title,
-		Tags:         tags,
-		Description:  livestreamModel.Description,
-		PlaylistUrl:  livestreamModel.PlaylistUrl,
-		ThumbnailUrl: livestreamModel.ThumbnailUrl,
-		StartAt:      livestreamModel.StartAt,
-		EndAt:        livestreamModel.EndAt,
+		ID:            livestreamModel.ID,
+		Owner:         owner,
+		Title:         livestreamModel.Title,
+		Tags:          tags,
+		Description:   livestreamModel.Description,
+		PlaylistUrl:   livestreamModel.PlaylistUrl,
+		ThumbnailUrl:  livestreamModel.ThumbnailUrl,
+		StartAt:       livestreamModel.StartAt,
+		EndAt:         livestreamModel.EndAt,
+		SeriesID:      livestreamModel.SeriesID,
+		Status:        livestreamModel.Status(time.Now().Unix()),
+		WentLiveAt:    livestreamModel.WentLiveAt,
+		EndedAt:       livestreamModel.EndedAt,
+		Collaborators: collaborators,
 	}
 	return livestream, nil
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sync"
+)
+
+// 購読者ごとの送信バッファ
+// 溢れた購読者は切断し、クライアントには再接続してもらう
+const livestreamSubscriberBufferSize = 64
+
+// ライブ配信ごとに配信されるイベントの種別
+const (
+	livestreamEventLivecommentCreated = "livecomment.created"
+	livestreamEventLivecommentDeleted = "livecomment.deleted"
+	// 非表示にしていたライブコメントを再表示した
+	livestreamEventLivecommentRestored = "livecomment.restored"
+	// スパム報告が一定数に達してライブコメントが自動で非表示になった
+	livestreamEventLivecommentAutoHidden = "moderation.auto_hidden"
+	livestreamEventReactionCreated       = "reaction.created"
+	livestreamEventViewersChanged        = "viewers.changed"
+	livestreamEventStatusChanged         = "livestream.status_changed"
+)
+
+var LivestreamEventHub = newLivestreamHub()
+
+type LivestreamEvent struct {
+	Type string `json:"type"`
+	Data any    `json:"data"`
+}
+
+type LivecommentDeletedEvent struct {
+	ID int64 `json:"id"`
+}
+
+type LivecommentAutoHiddenEvent struct {
+	LivecommentID int64  `json:"livecomment_id"`
+	Reason        string `json:"reason"`
+	ReportCount   int64  `json:"report_count"`
+}
+
+type ViewersChangedEvent struct {
+	ViewersCount int64 `json:"viewers_count"`
+}
+
+type livestreamSubscriber struct {
+	C chan LivestreamEvent
+}
+
+// ライブ配信ごとに、コメントやリアクションなどのイベントを購読者へ配るプロセス内のpub/sub
+type livestreamHub struct {
+	mu          sync.Mutex
+	subscribers map[int64]map[*livestreamSubscriber]struct{}
+}
+
+func newLivestreamHub() *livestreamHub {
+	return &livestreamHub{
+		subscribers: make(map[int64]map[*livestreamSubscriber]struct{}),
+	}
+}
+
+func (h *livestreamHub) Subscribe(livestreamID int64) *livestreamSubscriber {
+	sub := &livestreamSubscriber{
+		C: make(chan LivestreamEvent, livestreamSubscriberBufferSize),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	subs, ok := h.subscribers[livestreamID]
+	if !ok {
+		subs = make(map[*livestreamSubscriber]struct{})
+		h.subscribers[livestreamID] = subs
+	}
+	subs[sub] = struct{}{}
+
+	return sub
+}
+
+func (h *livestreamHub) Unsubscribe(livestreamID int64, sub *livestreamSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.removeLocked(livestreamID, sub)
+}
+
+func (h *livestreamHub) Publish(livestreamID int64, eventType string, data any) {
+	event := LivestreamEvent{
+		Type: eventType,
+		Data: data,
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subscribers[livestreamID] {
+		select {
+		case sub.C <- event:
+		default:
+			// 受信が追いつかない購読者はブロックせずに切り離す
+			h.removeLocked(livestreamID, sub)
+		}
+	}
+}
+
+func (h *livestreamHub) removeLocked(livestreamID int64, sub *livestreamSubscriber) {
+	subs, ok := h.subscribers[livestreamID]
+	if !ok {
+		return
+	}
+	if _, ok := subs[sub]; !ok {
+		return
+	}
+
+	delete(subs, sub)
+	close(sub.C)
+	if len(subs) == 0 {
+		delete(h.subscribers, livestreamID)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// ライブ配信の状態
+// scheduled → live → ended → archived の順に遷移する
+const (
+	livestreamStatusScheduled = "scheduled"
+	livestreamStatusLive      = "live"
+	livestreamStatusEnded     = "ended"
+	livestreamStatusArchived  = "archived"
+)
+
+const (
+	// 予約した開始時刻のどれだけ前から配信を開始できるか
+	livestreamGoLiveLeadTime = 15 * time.Minute
+	// 配信終了からアーカイブ扱いになるまでの期間
+	livestreamArchiveAfter = 7 * 24 * time.Hour
+)
+
+type LivestreamStatusChangedEvent struct {
+	Status string `json:"status"`
+}
+
+// 予約時刻と、配信者による開始・終了の操作から状態を求める
+func livestreamStatus(startAt, endAt int64, wentLiveAt, endedAt *int64, now int64) string {
+	if wentLiveAt != nil {
+		startAt = *wentLiveAt
+	}
+	if endedAt != nil && *endedAt < endAt {
+		endAt = *endedAt
+	}
+
+	switch {
+	case now < startAt:
+		return livestreamStatusScheduled
+	case now < endAt:
+		return livestreamStatusLive
+	case now < endAt+int64(livestreamArchiveAfter/time.Second):
+		return livestreamStatusEnded
+	default:
+		return livestreamStatusArchived
+	}
+}
+
+func (m LivestreamModel) Status(now int64) string {
+	return livestreamStatus(m.StartAt, m.EndAt, m.WentLiveAt, m.EndedAt, now)
+}
+
+// キャッシュしたレスポンスは時間が経つと状態が変わるので、返す前に求め直す
+// キャッシュ上のページは書き換えずにコピーを返す
+func refreshLivestreamPageStatus(page Page[Livestream], now int64) Page[Livestream] {
+	items := slices.Clone(page.Items)
+	for i := range items {
+		items[i].Status = livestreamStatus(items[i].StartAt, items[i].EndAt, items[i].WentLiveAt, items[i].EndedAt, now)
+	}
+	page.Items = items
+	return page
+}
+
+func refreshLivecommentPageStatus(page Page[Livecomment], now int64) Page[Livecomment] {
+	items := slices.Clone(page.Items)
+	for i := range items {
+		l := &items[i].Livestream
+		l.Status = livestreamStatus(l.StartAt, l.EndAt, l.WentLiveAt, l.EndedAt, now)
+	}
+	page.Items = items
+	return page
+}
+
+// 配信が指定した状態のいずれかであることを確認して取得する
+// 返すエラーはecho.NewHTTPErrorなのでそのまま出力してよい
+func getLivestreamInStatus(ctx context.Context, tx *sqlx.Tx, livestreamID int64, statuses ...string) (LivestreamModel, error) {
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return LivestreamModel{}, echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return LivestreamModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if err := checkLivestreamStatus(livestreamModel, statuses...); err != nil {
+		return LivestreamModel{}, err
+	}
+	return livestreamModel, nil
+}
+
+func checkLivestreamStatus(livestreamModel LivestreamModel, statuses ...string) error {
+	status := livestreamModel.Status(time.Now().Unix())
+	for _, s := range statuses {
+		if s == status {
+			return nil
+		}
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, "livestream is "+status)
+}
+
+// 配信の開始
+// 予約した開始時刻の少し前から開始できる
+// POST /api/livestream/:livestream_id/live
+func goLiveHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := getAuthUserID(c)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := getOwnedLivestreamForUpdate(ctx, tx, int64(livestreamID), userID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	if status := livestreamModel.Status(now); status != livestreamStatusScheduled {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream is already "+status)
+	}
+	if now < livestreamModel.StartAt-int64(livestreamGoLiveLeadTime/time.Second) {
+		return echo.NewHTTPError(http.StatusBadRequest, "it is too early to go live")
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET went_live_at = ? WHERE id = ?", now, livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream: "+err.Error())
+	}
+	livestreamModel.WentLiveAt = &now
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	invalidateLivestreamCaches(livestreamModel)
+	LivestreamEventHub.Publish(livestreamModel.ID, livestreamEventStatusChanged, LivestreamStatusChangedEvent{Status: livestream.Status})
+
+	return c.JSON(http.StatusOK, livestream)
+}
+
+// 配信の早期終了
+// 終了以降の予約枠は返却する
+// POST /api/livestream/:livestream_id/end
+func endLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := getAuthUserID(c)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := getOwnedLivestreamForUpdate(ctx, tx, int64(livestreamID), userID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	if status := livestreamModel.Status(now); status != livestreamStatusLive {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream is "+status)
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET ended_at = ? WHERE id = ?", now, livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream: "+err.Error())
+	}
+	livestreamModel.EndedAt = &now
+
+	// まだ始まっていない予約枠だけを返却する
+	if err := releaseReservationSlots(ctx, tx, now, livestreamModel.EndAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to release reservation_slots: "+err.Error())
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	invalidateLivestreamCaches(livestreamModel)
+	LivestreamEventHub.Publish(livestreamModel.ID, livestreamEventStatusChanged, LivestreamStatusChangedEvent{Status: livestream.Status})
+
+	return c.JSON(http.StatusOK, livestream)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLivestreamStatus(t *testing.T) {
+	const (
+		startAt = int64(1700000000)
+		endAt   = startAt + 3600
+	)
+	archiveAfter := int64(livestreamArchiveAfter.Seconds())
+	ptr := func(v int64) *int64 { return &v }
+
+	tests := []struct {
+		name       string
+		wentLiveAt *int64
+		endedAt    *int64
+		now        int64
+		want       string
+	}{
+		{name: "開始前は予約中", now: startAt - 1, want: livestreamStatusScheduled},
+		{name: "予約した開始時刻から配信中", now: startAt, want: livestreamStatusLive},
+		{name: "予約した終了時刻で終了", now: endAt, want: livestreamStatusEnded},
+		{name: "終了から一定期間はまだアーカイブではない", now: endAt + archiveAfter - 1, want: livestreamStatusEnded},
+		{name: "終了から一定期間でアーカイブ", now: endAt + archiveAfter, want: livestreamStatusArchived},
+
+		{name: "早めに開始すれば開始時刻前でも配信中", wentLiveAt: ptr(startAt - 600), now: startAt - 300, want: livestreamStatusLive},
+		{name: "開始の操作より前は予約中", wentLiveAt: ptr(startAt - 600), now: startAt - 601, want: livestreamStatusScheduled},
+
+		{name: "早期終了すれば予約した終了時刻前でも終了", endedAt: ptr(startAt + 600), now: startAt + 601, want: livestreamStatusEnded},
+		{name: "早期終了の前は配信中", endedAt: ptr(startAt + 600), now: startAt + 599, want: livestreamStatusLive},
+		{name: "アーカイブまでの期間は早期終了した時刻から数える", endedAt: ptr(startAt + 600), now: startAt + 600 + archiveAfter, want: livestreamStatusArchived},
+		{name: "予約した終了時刻より後の終了は無視する", endedAt: ptr(endAt + 600), now: endAt, want: livestreamStatusEnded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := livestreamStatus(startAt, endAt, tt.wentLiveAt, tt.endedAt, tt.now); got != tt.want {
+				t.Errorf("livestreamStatus(now=%d) = %q, want %q", tt.now, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRefreshLivestreamPageStatus(t *testing.T) {
+	const now = int64(1700000000)
+	page := Page[Livestream]{Items: []Livestream{
+		{ID: 1, StartAt: now - 60, EndAt: now + 60, Status: livestreamStatusScheduled},
+	}}
+
+	refreshed := refreshLivestreamPageStatus(page, now)
+	if got := refreshed.Items[0].Status; got != livestreamStatusLive {
+		t.Errorf("refreshed status = %q, want %q", got, livestreamStatusLive)
+	}
+	// キャッシュ上のページは書き換えない
+	if got := page.Items[0].Status; got != livestreamStatusScheduled {
+		t.Errorf("cached status = %q, want unchanged %q", got, livestreamStatusScheduled)
+	}
+}
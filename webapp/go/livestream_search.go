@@ -0,0 +1,210 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	livestreamSortNewest       = "newest"
+	livestreamSortStartingSoon = "starting_soon"
+	livestreamSortMostViewers  = "most_viewers"
+
+	// 検索条件としての状態。live, ended はライフサイクルの状態と同じ値を使う
+	livestreamStatusUpcoming = "upcoming"
+
+	livestreamTagModeAnd = "and"
+	livestreamTagModeOr  = "or"
+
+	maxLivestreamSearchQueryLength = 100
+)
+
+// 現在の視聴者数
+const livestreamViewersCountExpr = "(SELECT COUNT(*) FROM livestream_viewers_history WHERE livestream_viewers_history.livestream_id = livestreams.id)"
+
+// 配信検索の条件
+type livestreamSearchParams struct {
+	// タイトル・説明文のキーワード
+	Query string
+	Tags  []string
+	// and: すべてのタグを持つ配信, or: いずれかのタグを持つ配信
+	TagMode string
+	Status  string
+	// 配信者のユーザ名
+	Owner string
+	Sort  string
+}
+
+type livestreamSearchRow struct {
+	LivestreamModel
+	ViewersCount int64 `db:"viewers_count"`
+}
+
+func parseLivestreamSearchParams(c echo.Context) (livestreamSearchParams, error) {
+	params := livestreamSearchParams{
+		Query:   strings.TrimSpace(c.QueryParam("q")),
+		TagMode: c.QueryParam("tag_mode"),
+		Status:  c.QueryParam("status"),
+		Owner:   c.QueryParam("owner"),
+		Sort:    c.QueryParam("sort"),
+	}
+
+	if utf8.RuneCountInString(params.Query) > maxLivestreamSearchQueryLength {
+		return livestreamSearchParams{}, echo.NewHTTPError(http.StatusBadRequest, "q query parameter is too long")
+	}
+
+	// 重複を除いて並べておくと、キャッシュキーが指定順に依存しない
+	for _, tag := range c.QueryParams()["tag"] {
+		if tag != "" && !slices.Contains(params.Tags, tag) {
+			params.Tags = append(params.Tags, tag)
+		}
+	}
+	slices.Sort(params.Tags)
+
+	switch params.TagMode {
+	case "":
+		params.TagMode = livestreamTagModeOr
+	case livestreamTagModeAnd, livestreamTagModeOr:
+	default:
+		return livestreamSearchParams{}, echo.NewHTTPError(http.StatusBadRequest, "tag_mode query parameter must be and or or")
+	}
+
+	switch params.Status {
+	case "", livestreamStatusUpcoming, livestreamStatusLive, livestreamStatusEnded:
+	default:
+		return livestreamSearchParams{}, echo.NewHTTPError(http.StatusBadRequest, "status query parameter must be upcoming, live or ended")
+	}
+
+	switch params.Sort {
+	case "":
+		params.Sort = livestreamSortNewest
+	case livestreamSortNewest, livestreamSortStartingSoon, livestreamSortMostViewers:
+	default:
+		return livestreamSearchParams{}, echo.NewHTTPError(http.StatusBadRequest, "sort query parameter must be newest, starting_soon or most_viewers")
+	}
+
+	return params, nil
+}
+
+func (p livestreamSearchParams) CacheKey() string {
+	v := url.Values{}
+	v.Set("q", p.Query)
+	v["tag"] = p.Tags
+	v.Set("tag_mode", p.TagMode)
+	v.Set("status", p.Status)
+	v.Set("owner", p.Owner)
+	v.Set("sort", p.Sort)
+	return v.Encode()
+}
+
+// 時刻や視聴者数によって結果が変わる検索はキャッシュしない
+func (p livestreamSearchParams) Cacheable() bool {
+	return p.Status == "" && p.Sort != livestreamSortMostViewers
+}
+
+// 並び順のキーとなる式と、昇順かどうか
+func (p livestreamSearchParams) sortKey() (string, bool) {
+	switch p.Sort {
+	case livestreamSortStartingSoon:
+		return "livestreams.start_at", true
+	case livestreamSortMostViewers:
+		return livestreamViewersCountExpr, false
+	default:
+		return "livestreams.id", false
+	}
+}
+
+func (p livestreamSearchParams) cursorOf(row *livestreamSearchRow) pageCursor {
+	switch p.Sort {
+	case livestreamSortStartingSoon:
+		return pageCursor{Key: row.StartAt, ID: row.ID}
+	case livestreamSortMostViewers:
+		return pageCursor{Key: row.ViewersCount, ID: row.ID}
+	default:
+		return pageCursor{Key: row.ID, ID: row.ID}
+	}
+}
+
+func (p livestreamSearchParams) buildQuery(pageReq pageRequest, now int64) (string, []any, error) {
+	var conds []string
+	var args []any
+
+	if keywords := livestreamSearchKeywords(p.Query); keywords != "" {
+		conds = append(conds, "MATCH (livestreams.title, livestreams.description) AGAINST (? IN BOOLEAN MODE)")
+		args = append(args, keywords)
+	}
+
+	if len(p.Tags) > 0 {
+		subquery := "SELECT livestream_tags.livestream_id FROM livestream_tags INNER JOIN tags ON tags.id = livestream_tags.tag_id WHERE tags.name IN (?)"
+		args = append(args, p.Tags)
+		if p.TagMode == livestreamTagModeAnd {
+			subquery += " GROUP BY livestream_tags.livestream_id HAVING COUNT(DISTINCT tags.id) = ?"
+			args = append(args, len(p.Tags))
+		}
+		conds = append(conds, "livestreams.id IN ("+subquery+")")
+	}
+
+	// 配信者が開始・終了した時刻があればそちらを優先する (livestreamStatusと同じ判定)
+	switch p.Status {
+	case livestreamStatusUpcoming:
+		conds = append(conds, "COALESCE(livestreams.went_live_at, livestreams.start_at) > ?")
+		args = append(args, now)
+	case livestreamStatusLive:
+		conds = append(conds, "COALESCE(livestreams.went_live_at, livestreams.start_at) <= ? AND LEAST(livestreams.end_at, COALESCE(livestreams.ended_at, livestreams.end_at)) > ?")
+		args = append(args, now, now)
+	case livestreamStatusEnded:
+		conds = append(conds, "LEAST(livestreams.end_at, COALESCE(livestreams.ended_at, livestreams.end_at)) <= ?")
+		args = append(args, now)
+	}
+
+	if p.Owner != "" {
+		conds = append(conds, "livestreams.user_id = (SELECT id FROM users WHERE name = ?)")
+		args = append(args, p.Owner)
+	}
+
+	keyColumn, asc := p.sortKey()
+	var cond string
+	var condArgs []any
+	if asc {
+		cond, condArgs = pageReq.WhereAsc(keyColumn, "livestreams.id")
+	} else {
+		cond, condArgs = pageReq.Where(keyColumn, "livestreams.id")
+	}
+	if cond != "" {
+		conds = append(conds, cond)
+		args = append(args, condArgs...)
+	}
+
+	query := "SELECT livestreams.*, " + livestreamViewersCountExpr + " AS viewers_count FROM livestreams"
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	if asc {
+		query += pageReq.OrderByAndLimitAsc(keyColumn, "livestreams.id")
+	} else {
+		query += pageReq.OrderByAndLimit(keyColumn, "livestreams.id")
+	}
+
+	// タグのIN句を展開する
+	return sqlx.In(query, args...)
+}
+
+// 空白区切りのキーワードを、すべてを含むFULLTEXT(BOOLEAN MODE)の検索式にする
+// ngramパーサでは""で囲んだ語はフレーズとして検索される
+func livestreamSearchKeywords(q string) string {
+	var terms []string
+	for _, word := range strings.Fields(q) {
+		word = strings.ReplaceAll(word, `"`, "")
+		if word == "" {
+			continue
+		}
+		terms = append(terms, `+"`+word+`"`)
+	}
+	return strings.Join(terms, " ")
+}
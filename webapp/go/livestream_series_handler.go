@@ -0,0 +1,282 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	recurrenceFrequencyDaily  = "daily"
+	recurrenceFrequencyWeekly = "weekly"
+
+	// 一度に予約できる最大の回数
+	maxRecurrenceOccurrences = 100
+)
+
+// 繰り返し予約のルール
+// Count と Until のどちらかを指定する。両方指定した場合は先に到達した方で打ち切る
+type RecurrenceRule struct {
+	// daily | weekly
+	Frequency string `json:"frequency"`
+	// 何日(週)おきか。省略時は1
+	Interval int `json:"interval"`
+	Count    int `json:"count"`
+	// この時刻以前に開始する回までを予約する
+	Until int64 `json:"until"`
+	// trueなら予約できない回をスキップして残りを予約する
+	// falseならすべての回が予約できる場合のみ予約する
+	BestEffort bool `json:"best_effort"`
+}
+
+type LivestreamSeriesModel struct {
+	ID        int64 `db:"id"`
+	UserID    int64 `db:"user_id"`
+	CreatedAt int64 `db:"created_at"`
+}
+
+type ReservationOccurrenceResult struct {
+	StartAt    int64       `json:"start_at"`
+	EndAt      int64       `json:"end_at"`
+	Livestream *Livestream `json:"livestream,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+type ReserveLivestreamSeriesResponse struct {
+	SeriesID    int64                         `json:"series_id"`
+	Occurrences []ReservationOccurrenceResult `json:"occurrences"`
+}
+
+type CancelLivestreamSeriesResponse struct {
+	CancelledLivestreamIDs []int64 `json:"cancelled_livestream_ids"`
+}
+
+// 繰り返し予約の各回の開始・終了時刻を展開する
+func expandRecurrence(rule RecurrenceRule, startAt, endAt int64) ([][2]int64, error) {
+	var period time.Duration
+	switch rule.Frequency {
+	case recurrenceFrequencyDaily:
+		period = 24 * time.Hour
+	case recurrenceFrequencyWeekly:
+		period = 7 * 24 * time.Hour
+	default:
+		return nil, fmt.Errorf("recurrence frequency must be %q or %q", recurrenceFrequencyDaily, recurrenceFrequencyWeekly)
+	}
+
+	interval := rule.Interval
+	if interval == 0 {
+		interval = 1
+	}
+	if interval < 0 {
+		return nil, fmt.Errorf("recurrence interval must be positive")
+	}
+	if rule.Count < 0 {
+		return nil, fmt.Errorf("recurrence count must be positive")
+	}
+	if rule.Count == 0 && rule.Until == 0 {
+		return nil, fmt.Errorf("either recurrence count or until is required")
+	}
+	if rule.Count > maxRecurrenceOccurrences {
+		return nil, fmt.Errorf("recurrence count must be less than or equal to %d", maxRecurrenceOccurrences)
+	}
+
+	step := int64(period/time.Second) * int64(interval)
+	var occurrences [][2]int64
+	for i := int64(0); ; i++ {
+		if rule.Count > 0 && len(occurrences) >= rule.Count {
+			break
+		}
+		s := startAt + step*i
+		if rule.Until > 0 && s > rule.Until {
+			break
+		}
+		if len(occurrences) >= maxRecurrenceOccurrences {
+			return nil, fmt.Errorf("recurrence must not exceed %d occurrences", maxRecurrenceOccurrences)
+		}
+		occurrences = append(occurrences, [2]int64{s, endAt + step*i})
+	}
+	if len(occurrences) == 0 {
+		return nil, fmt.Errorf("recurrence has no occurrences")
+	}
+
+	return occurrences, nil
+}
+
+// 繰り返し予約
+// POST /api/livestream/reservation で recurrence が指定された場合に呼ばれる
+func reserveLivestreamSeries(c echo.Context, userID int64, req *ReserveLivestreamRequest) error {
+	ctx := c.Request().Context()
+
+	occurrences, err := expandRecurrence(*req.Recurrence, req.StartAt, req.EndAt)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	seriesModel := LivestreamSeriesModel{
+		UserID:    userID,
+		CreatedAt: time.Now().Unix(),
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_series (user_id, created_at) VALUES (:user_id, :created_at)", seriesModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream series: "+err.Error())
+	}
+	seriesID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livestream series id: "+err.Error())
+	}
+
+	results := make([]ReservationOccurrenceResult, len(occurrences))
+	reserved := 0
+	for i, occurrence := range occurrences {
+		results[i] = ReservationOccurrenceResult{
+			StartAt: occurrence[0],
+			EndAt:   occurrence[1],
+		}
+
+		livestreamModel, err := reserveLivestream(ctx, tx, userID, req, occurrence[0], occurrence[1], &seriesID)
+		if err != nil {
+			var he *echo.HTTPError
+			if !errors.As(err, &he) || he.Code != http.StatusBadRequest {
+				return err
+			}
+			if !req.Recurrence.BestEffort {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("occurrence %d (%d ~ %d) can't be reserved: %v", i+1, occurrence[0], occurrence[1], he.Message))
+			}
+			results[i].Error = fmt.Sprintf("%v", he.Message)
+			continue
+		}
+
+		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		}
+		results[i].Livestream = &livestream
+		reserved++
+	}
+
+	if reserved == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "no occurrence can be reserved")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	LivestreamCache.Remove(fmt.Sprintf("%d", userID))
+	SearchLivestreamCache.Purge()
+
+	return c.JSON(http.StatusCreated, ReserveLivestreamSeriesResponse{
+		SeriesID:    seriesID,
+		Occurrences: results,
+	})
+}
+
+// 繰り返し予約された配信の一覧
+// GET /api/livestream/series/:series_id
+func getLivestreamSeriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	seriesID, err := strconv.Atoi(c.Param("series_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "series_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var seriesModel LivestreamSeriesModel
+	if err := tx.GetContext(ctx, &seriesModel, "SELECT * FROM livestream_series WHERE id = ?", seriesID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream series not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream series: "+err.Error())
+	}
+
+	var livestreamModels []*LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE series_id = ? ORDER BY start_at", seriesID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+	livestreams := make([]Livestream, len(livestreamModels))
+	for i := range livestreamModels {
+		livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModels[i])
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+		}
+		livestreams[i] = livestream
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestreams)
+}
+
+// 繰り返し予約のうち、まだ開始していない回をまとめて取り消す
+// DELETE /api/livestream/series/:series_id
+func cancelLivestreamSeriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := getAuthUserID(c)
+
+	seriesID, err := strconv.Atoi(c.Param("series_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "series_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var seriesModel LivestreamSeriesModel
+	if err := tx.GetContext(ctx, &seriesModel, "SELECT * FROM livestream_series WHERE id = ?", seriesID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream series not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream series: "+err.Error())
+	}
+	if seriesModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't cancel other streamer's livestream series")
+	}
+
+	var livestreamModels []*LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE series_id = ? AND start_at > ? AND went_live_at IS NULL FOR UPDATE", seriesID, time.Now().Unix()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+
+	cancelled := make([]int64, len(livestreamModels))
+	for i := range livestreamModels {
+		if err := cancelLivestream(ctx, tx, *livestreamModels[i]); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to cancel livestream: "+err.Error())
+		}
+		cancelled[i] = livestreamModels[i].ID
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	for i := range livestreamModels {
+		invalidateLivestreamCaches(*livestreamModels[i])
+	}
+
+	return c.JSON(http.StatusOK, CancelLivestreamSeriesResponse{
+		CancelledLivestreamIDs: cancelled,
+	})
+}
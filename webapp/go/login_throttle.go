@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ログイン失敗時のバックオフの設定
+// FreeAttempts回までの失敗は制限せず、それ以降は失敗のたびにBaseLockoutから倍々にロックする
+type LoginFailurePolicy struct {
+	FreeAttempts int
+	BaseLockout  time.Duration
+	MaxLockout   time.Duration
+	// 最後の失敗からこの期間が過ぎると、失敗回数を数え直す
+	Window time.Duration
+}
+
+var (
+	// ユーザ名ごと。特定のアカウントへの総当たりを防ぐ
+	loginUsernameFailurePolicy = LoginFailurePolicy{FreeAttempts: 5, BaseLockout: 1 * time.Second, MaxLockout: 15 * time.Minute, Window: 15 * time.Minute}
+	// IPアドレスごと。多数のアカウントへのパスワードスプレーを防ぐ
+	// NATの内側の利用者をまとめて締め出さないよう、ユーザ名より緩くする
+	loginIPFailurePolicy = LoginFailurePolicy{FreeAttempts: 20, BaseLockout: 1 * time.Second, MaxLockout: 15 * time.Minute, Window: 15 * time.Minute}
+)
+
+// ユーザ名、IPアドレスそれぞれで保持する失敗回数の上限
+const loginThrottleMaxEntries = 65536
+
+// 監査ログに記録できるユーザ名の長さ。users.nameより長いユーザ名は存在しないので、切り詰めて数えてよい
+const maxLoginUsernameLength = 255
+
+// パスワードの照合の前に数えた試行
+type LoginAttempt struct {
+	// この試行を含めた失敗回数
+	Count int
+	// この試行で新たにロックした期間。ロックしていなければ0
+	Lockout time.Duration
+}
+
+// ログイン失敗回数とロックの状態を保持するストア
+// 複数台で失敗回数を共有する場合は、DBなどを使う実装に差し替える
+type LoginThrottle interface {
+	// keyがロックされていれば、何も数えずにロックが解けるまでの時間を返す
+	// ロックされていなければ、パスワードを照合する前に試行を失敗として数える
+	// 確認と記録を一度に行うので、同時に送られた試行がロックをすり抜けて照合されることはない
+	Begin(key string, policy LoginFailurePolicy, now time.Time) (LoginAttempt, time.Duration)
+	// Beginで数えた試行を取り消す
+	Cancel(key string, attempt LoginAttempt)
+	// 失敗回数を破棄する
+	Clear(key string)
+	// すべての状態を破棄する
+	Reset()
+}
+
+// ユーザ名とIPアドレスは別々に保持し、一方を大量に送って他方の失敗回数を溢れさせられないようにする
+var (
+	loginUsernameThrottle LoginThrottle = newMemoryLoginThrottle(loginThrottleMaxEntries)
+	loginIPThrottle       LoginThrottle = newMemoryLoginThrottle(loginThrottleMaxEntries)
+)
+
+type loginFailures struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+	// ロックが解け、失敗回数を数え直す時刻。これを過ぎるまでは破棄しない
+	expiresAt time.Time
+}
+
+// 失敗回数をプロセス内に保持する
+// 古いものから追い出すと、総当たりの最中のユーザ名が無関係な試行に押し出されてロックが外れてしまう
+// そのため期限の過ぎていない失敗回数は破棄せず、上限に達したら期限が過ぎるまで新しいキーの試行を受け付けない
+type memoryLoginThrottle struct {
+	mu       sync.Mutex
+	size     int
+	failures map[string]*loginFailures
+	// 上限に達しているとき、この時刻までは期限の過ぎた失敗回数がないので探さない
+	nextExpiry time.Time
+}
+
+func newMemoryLoginThrottle(size int) *memoryLoginThrottle {
+	return &memoryLoginThrottle{size: size, failures: map[string]*loginFailures{}}
+}
+
+func (t *memoryLoginThrottle) Begin(key string, policy LoginFailurePolicy, now time.Time) (LoginAttempt, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.failures[key]
+	if ok && !now.Before(f.expiresAt) {
+		delete(t.failures, key)
+		ok = false
+	}
+	if ok && now.Before(f.lockedUntil) {
+		return LoginAttempt{}, f.lockedUntil.Sub(now)
+	}
+	if !ok {
+		if wait := t.makeRoom(now); wait > 0 {
+			return LoginAttempt{}, wait
+		}
+		f = &loginFailures{}
+		t.failures[key] = f
+	}
+	f.count++
+	f.lastFailure = now
+
+	attempt := LoginAttempt{Count: f.count}
+	if f.count > policy.FreeAttempts {
+		attempt.Lockout = policy.MaxLockout
+		if exp := f.count - policy.FreeAttempts - 1; exp < 32 {
+			attempt.Lockout = min(policy.BaseLockout<<exp, policy.MaxLockout)
+		}
+		f.lockedUntil = now.Add(attempt.Lockout)
+	}
+	f.expiresAt = now.Add(policy.Window)
+	if f.lockedUntil.After(f.expiresAt) {
+		f.expiresAt = f.lockedUntil
+	}
+	return attempt, 0
+}
+
+// 上限に達していれば期限の過ぎた失敗回数を破棄する
+// それでも空きがなければ、次に期限が過ぎるまでの時間を返す
+func (t *memoryLoginThrottle) makeRoom(now time.Time) time.Duration {
+	if len(t.failures) < t.size {
+		return 0
+	}
+	if now.Before(t.nextExpiry) {
+		return t.nextExpiry.Sub(now)
+	}
+
+	var next time.Time
+	for key, f := range t.failures {
+		if !now.Before(f.expiresAt) {
+			delete(t.failures, key)
+		} else if next.IsZero() || f.expiresAt.Before(next) {
+			next = f.expiresAt
+		}
+	}
+	if len(t.failures) < t.size {
+		return 0
+	}
+	t.nextExpiry = next
+	return next.Sub(now)
+}
+
+func (t *memoryLoginThrottle) Cancel(key string, attempt LoginAttempt) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.failures[key]
+	if !ok {
+		return
+	}
+	if f.count > 0 {
+		f.count--
+	}
+	// Beginはロックされていないときだけ数えるので、この試行がかけたロックを外せば元に戻る
+	if attempt.Lockout > 0 {
+		f.lockedUntil = time.Time{}
+	}
+}
+
+func (t *memoryLoginThrottle) Clear(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.failures, key)
+	t.nextExpiry = time.Time{}
+}
+
+func (t *memoryLoginThrottle) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failures = map[string]*loginFailures{}
+	t.nextExpiry = time.Time{}
+}
+
+// パスワードを照合する前に数えた、ユーザ名とIPアドレスそれぞれの試行
+type loginAttempts struct {
+	username        string
+	ip              string
+	usernameAttempt LoginAttempt
+	ipAttempt       LoginAttempt
+}
+
+// ユーザ名とIPアドレスがロックされていなければ、試行を失敗として先に数える
+// ロックされていれば、Retry-Afterを付けて429を返す。ロック中はパスワードを照合しない
+// 返すエラーはecho.NewHTTPErrorなのでそのまま出力してよい
+func beginLoginAttempt(c echo.Context, username string) (*loginAttempts, error) {
+	now := time.Now()
+	if utf8.RuneCountInString(username) > maxLoginUsernameLength {
+		username = string([]rune(username)[:maxLoginUsernameLength])
+	}
+	a := &loginAttempts{username: username, ip: c.RealIP()}
+
+	var wait time.Duration
+	a.usernameAttempt, wait = loginUsernameThrottle.Begin(a.username, loginUsernameFailurePolicy, now)
+	if wait <= 0 {
+		a.ipAttempt, wait = loginIPThrottle.Begin(a.ip, loginIPFailurePolicy, now)
+		if wait > 0 {
+			// 照合しない試行はユーザ名の失敗として数えない
+			loginUsernameThrottle.Cancel(a.username, a.usernameAttempt)
+		}
+	}
+	if wait <= 0 {
+		return a, nil
+	}
+
+	retryAfter := int64(math.Ceil(wait.Seconds()))
+	c.Response().Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	return nil, echo.NewHTTPError(http.StatusTooManyRequests, fmt.Sprintf("too many failed login attempts, retry after %d seconds", retryAfter))
+}
+
+// ログインに成功したので、ユーザ名の失敗回数を破棄し、IPアドレスではこの試行を取り消す
+// IPアドレスの失敗回数まで破棄すると、自分のアカウントへのログインを挟んでパスワードスプレーの制限を回避できてしまう
+func (a *loginAttempts) Succeed() {
+	loginUsernameThrottle.Clear(a.username)
+	loginIPThrottle.Cancel(a.ip, a.ipAttempt)
+}
+
+// ログインに失敗した。試行は数えてあるので、ロックした場合に監査ログに残す
+func (a *loginAttempts) Fail(ctx context.Context) error {
+	now := time.Now().Unix()
+	if lockout := a.usernameAttempt.Lockout; lockout > 0 {
+		if err := recordAuditEvent(ctx, auditEventLoginLockoutUsername, a.username, a.ip, fmt.Sprintf("failures=%d lockout_seconds=%d", a.usernameAttempt.Count, int64(lockout/time.Second)), now); err != nil {
+			return err
+		}
+	}
+	if lockout := a.ipAttempt.Lockout; lockout > 0 {
+		if err := recordAuditEvent(ctx, auditEventLoginLockoutIP, a.username, a.ip, fmt.Sprintf("failures=%d lockout_seconds=%d", a.ipAttempt.Count, int64(lockout/time.Second)), now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+var testLoginFailurePolicy = LoginFailurePolicy{FreeAttempts: 3, BaseLockout: 1 * time.Second, MaxLockout: 8 * time.Second, Window: 1 * time.Minute}
+
+func TestMemoryLoginThrottleLockout(t *testing.T) {
+	th := newMemoryLoginThrottle(16)
+	now := time.Unix(1700000000, 0)
+
+	// FreeAttempts回まではロックしない
+	for i := 1; i <= testLoginFailurePolicy.FreeAttempts; i++ {
+		attempt, wait := th.Begin("k", testLoginFailurePolicy, now)
+		if wait != 0 || attempt.Count != i || attempt.Lockout != 0 {
+			t.Fatalf("attempt %d: got %+v wait=%v, want count=%d without lockout", i, attempt, wait, i)
+		}
+	}
+
+	// それ以降は失敗のたびに倍々にロックし、MaxLockoutで頭打ちになる
+	for _, want := range []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second} {
+		attempt, wait := th.Begin("k", testLoginFailurePolicy, now)
+		if wait != 0 || attempt.Lockout != want {
+			t.Fatalf("got %+v wait=%v, want lockout=%v", attempt, wait, want)
+		}
+
+		// ロック中の試行は数えずに、ロックが解けるまでの時間を返す
+		if attempt, wait := th.Begin("k", testLoginFailurePolicy, now.Add(want/2)); wait != want-want/2 || attempt != (LoginAttempt{}) {
+			t.Fatalf("during lockout: got %+v wait=%v, want wait=%v", attempt, wait, want-want/2)
+		}
+		now = now.Add(want)
+	}
+}
+
+func TestMemoryLoginThrottleWindow(t *testing.T) {
+	th := newMemoryLoginThrottle(16)
+	now := time.Unix(1700000000, 0)
+
+	for i := 0; i < testLoginFailurePolicy.FreeAttempts; i++ {
+		th.Begin("k", testLoginFailurePolicy, now)
+	}
+	// 最後の失敗からWindowが過ぎると数え直す
+	attempt, _ := th.Begin("k", testLoginFailurePolicy, now.Add(testLoginFailurePolicy.Window+time.Second))
+	if attempt.Count != 1 || attempt.Lockout != 0 {
+		t.Fatalf("got %+v, want count=1 without lockout", attempt)
+	}
+}
+
+func TestMemoryLoginThrottleCancel(t *testing.T) {
+	th := newMemoryLoginThrottle(16)
+	now := time.Unix(1700000000, 0)
+
+	for i := 0; i < testLoginFailurePolicy.FreeAttempts; i++ {
+		th.Begin("k", testLoginFailurePolicy, now)
+	}
+	attempt, _ := th.Begin("k", testLoginFailurePolicy, now)
+	if attempt.Lockout == 0 {
+		t.Fatalf("got %+v, want lockout", attempt)
+	}
+
+	// 照合に成功した試行を取り消すと、その試行がかけたロックも外れる
+	th.Cancel("k", attempt)
+	if attempt, wait := th.Begin("k", testLoginFailurePolicy, now); wait != 0 || attempt.Count != testLoginFailurePolicy.FreeAttempts+1 {
+		t.Fatalf("after cancel: got %+v wait=%v, want count=%d", attempt, wait, testLoginFailurePolicy.FreeAttempts+1)
+	}
+
+	th.Clear("k")
+	if attempt, wait := th.Begin("k", testLoginFailurePolicy, now); wait != 0 || attempt.Count != 1 {
+		t.Fatalf("after clear: got %+v wait=%v, want count=1", attempt, wait)
+	}
+}
+
+func TestMemoryLoginThrottleConcurrentBegin(t *testing.T) {
+	th := newMemoryLoginThrottle(16)
+	now := time.Unix(1700000000, 0)
+
+	// 同時に送られた試行のうち、照合まで進めるのはロックがかかる試行までに限られる
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	admitted := 0
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, wait := th.Begin("k", testLoginFailurePolicy, now); wait == 0 {
+				mu.Lock()
+				admitted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if want := testLoginFailurePolicy.FreeAttempts + 1; admitted != want {
+		t.Errorf("admitted %d attempts, want %d", admitted, want)
+	}
+}
+
+func TestMemoryLoginThrottleFull(t *testing.T) {
+	th := newMemoryLoginThrottle(2)
+	now := time.Unix(1700000000, 0)
+
+	// ロックされているユーザ名は、他のキーの試行で溢れても破棄しない
+	for i := 0; i <= testLoginFailurePolicy.FreeAttempts; i++ {
+		th.Begin("victim", testLoginFailurePolicy, now)
+	}
+	th.Begin("junk1", testLoginFailurePolicy, now)
+	if _, wait := th.Begin("junk2", testLoginFailurePolicy, now); wait != testLoginFailurePolicy.Window {
+		t.Fatalf("new key on a full throttle: wait=%v, want %v", wait, testLoginFailurePolicy.Window)
+	}
+	if _, wait := th.Begin("victim", testLoginFailurePolicy, now); wait == 0 {
+		t.Fatalf("victim is no longer locked after the throttle filled up")
+	}
+
+	// 期限が過ぎたものを破棄すれば、新しいキーを数えられる
+	later := now.Add(testLoginFailurePolicy.Window)
+	if attempt, wait := th.Begin("junk2", testLoginFailurePolicy, later); wait != 0 || attempt.Count != 1 {
+		t.Fatalf("after expiry: got %+v wait=%v, want count=1", attempt, wait)
+	}
+}
@@ -5,6 +5,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/go-sql-driver/mysql"
 	lru "github.com/hashicorp/golang-lru/v2"
@@ -20,6 +21,7 @@ import (
 	"os"
 	"os/exec"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/sessions"
 	"github.com/labstack/echo-contrib/session"
@@ -38,6 +40,7 @@ import (
 var LivestreamCache *lru.Cache[string, any]
 var SearchLivestreamCache *lru.Cache[string, any]
 var LivecommentCache *lru.Cache[string, any]
+var NGWordMatcherCache *lru.Cache[string, any]
 
 const (
 	listenPort                     = 8080
@@ -48,6 +51,7 @@ var (
 	powerDNSSubdomainAddress string
 	dbConn                   *sqlx.DB
 	secret                   = []byte("isucon13_session_cookiestore_defaultsecret")
+	adminUsernames           []string
 )
 
 var (
@@ -92,6 +96,21 @@ func init() {
 	if secretKey, ok := os.LookupEnv("ISUCON13_SESSION_SECRETKEY"); ok {
 		secret = []byte(secretKey)
 	}
+	if v, ok := os.LookupEnv("ISUCON13_ADMIN_USERNAMES"); ok && v != "" {
+		adminUsernames = strings.Split(v, ",")
+	}
+	if err := loadReservationConfig(); err != nil {
+		log.Fatalf("failed to load reservation config: %+v", err)
+	}
+	if err := loadLivecommentValidationConfig(); err != nil {
+		log.Fatalf("failed to load livecomment validation config: %+v", err)
+	}
+	if err := loadSessionStoreConfig(); err != nil {
+		log.Fatalf("failed to load session store config: %+v", err)
+	}
+	if err := loadPasswordConfig(); err != nil {
+		log.Fatalf("failed to load password config: %+v", err)
+	}
 }
 
 type InitializeResponse struct {
@@ -167,16 +186,28 @@ func initializeHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
 	}
 
-	SearchLivestreamCache, err = lru.New[string, any](512)
+	SearchLivestreamCache, err = newIndexedCache(512, searchLivestreamCacheUsers)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
+	}
+
+	LivecommentCache, err = newIndexedCache(512, livecommentCacheUsers)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
 	}
 
-	LivecommentCache, err = lru.New[string, any](512)
+	NGWordMatcherCache, err = lru.New[string, any](512)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
 	}
 
+	PostRateLimiter.Reset()
+	loginUsernameThrottle.Reset()
+	loginIPThrottle.Reset()
+	if err := sessionStore.Reset(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
+	}
+
 	err = os.RemoveAll("/tmp/image")
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
@@ -192,6 +223,11 @@ func initializeHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
 	}
 
+	// init.shで初期データの予約枠に戻るので、設定された予約期間を登録し直す
+	if err := ensureConfiguredReservationTerm(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
+	}
+
 	c.Request().Header.Add("Content-Type", "application/json;charset=utf-8")
 	return c.JSON(http.StatusOK, InitializeResponse{
 		Language: "golang",
@@ -205,64 +241,138 @@ func main() {
 	e := echo.New()
 	e.Debug = true
 	e.Logger.SetLevel(echolog.DEBUG)
+	// c.RealIP()はログイン試行の制限やセッションに使うので、クライアントが送るヘッダをそのまま信用しない
+	// 直前がループバックやプライベートアドレスのプロキシのときだけ、X-Forwarded-Forをそのプロキシが追記した側から辿る
+	e.IPExtractor = echo.ExtractIPFromXFFHeader()
 	e.Use(middleware.Logger())
 	cookieStore := sessions.NewCookieStore(secret)
 	cookieStore.Options.Domain = "*.t.isucon.pw"
 	e.Use(session.Middleware(cookieStore))
+	// Authorization: Bearer のAPIトークン。受け付けるAPIはrequireAuthにスコープを指定したグループに登録する
+	e.Use(apiTokenMiddleware)
 	// e.Use(middleware.Recover())
 
 	e.Use(otelecho.Middleware(serviceName))
 
+	// ログインが必要なAPI。APIトークンでは呼び出せない
+	api := e.Group("/api", requireAuth(""))
+	// ログインが必要なAPIのうち、APIトークンでも呼び出せるもの
+	readLivecommentsAPI := e.Group("/api", requireAuth(apiTokenScopeReadLivecomments))
+	writeLivecommentsAPI := e.Group("/api", requireAuth(apiTokenScopeWriteLivecomments))
+	moderateAPI := e.Group("/api", requireAuth(apiTokenScopeModerate))
+	statsAPI := e.Group("/api", requireAuth(apiTokenScopeStats))
+	// 管理者向けAPI
+	adminAPI := e.Group("/api/admin", requireAuth(""), requireAdmin)
+
 	// 初期化
 	e.POST("/api/initialize", initializeHandler)
 
 	// top
 	e.GET("/api/tag", getTagHandler)
-	e.GET("/api/user/:username/theme", getStreamerThemeHandler)
+	api.GET("/user/:username/theme", getStreamerThemeHandler)
 
 	// livestream
 	// reserve livestream
-	e.POST("/api/livestream/reservation", reserveLivestreamHandler)
+	api.POST("/livestream/reservation", reserveLivestreamHandler)
+	// reservation slots
+	api.GET("/reservation_slots", getReservationSlotsHandler)
+	api.GET("/reservation_slots/suggest", suggestReservationSlotsHandler)
+	api.GET("/reservation_terms", getReservationTermsHandler)
+	// (管理者向け)予約期間の追加
+	adminAPI.POST("/reservation_terms", postReservationTermHandler)
 	// list livestream
 	e.GET("/api/livestream/search", searchLivestreamsHandler)
-	e.GET("/api/livestream", getMyLivestreamsHandler)
-	e.GET("/api/user/:username/livestream", getUserLivestreamsHandler)
+	api.GET("/livestream", getMyLivestreamsHandler)
+	api.GET("/user/:username/livestream", getUserLivestreamsHandler)
 	// get livestream
-	e.GET("/api/livestream/:livestream_id", getLivestreamHandler)
+	api.GET("/livestream/:livestream_id", getLivestreamHandler)
+	// edit / cancel reserved livestream
+	api.PATCH("/livestream/:livestream_id", updateLivestreamHandler)
+	api.DELETE("/livestream/:livestream_id", cancelLivestreamHandler)
+	// 配信の開始・早期終了
+	api.POST("/livestream/:livestream_id/live", goLiveHandler)
+	api.POST("/livestream/:livestream_id/end", endLivestreamHandler)
+	// recurring livestream series
+	api.GET("/livestream/series/:series_id", getLivestreamSeriesHandler)
+	api.DELETE("/livestream/series/:series_id", cancelLivestreamSeriesHandler)
+	// コラボレーターの招待・承諾
+	api.GET("/livestream/:livestream_id/collaborators", getCollaboratorsHandler)
+	api.POST("/livestream/:livestream_id/collaborators", postCollaboratorHandler)
+	api.POST("/livestream/:livestream_id/collaborators/accept", acceptCollaborationHandler)
+	api.POST("/livestream/:livestream_id/collaborators/decline", declineCollaborationHandler)
 	// get polling livecomment timeline
-	e.GET("/api/livestream/:livestream_id/livecomment", getLivecommentsHandler)
+	readLivecommentsAPI.GET("/livestream/:livestream_id/livecomment", getLivecommentsHandler)
+	// ライブコメントのSSEストリーム
+	readLivecommentsAPI.GET("/livestream/:livestream_id/livecomment/stream", streamLivecommentsHandler)
+	// コメント・リアクション・視聴者数をまとめて受け取るWebSocket
+	readLivecommentsAPI.GET("/livestream/:livestream_id/ws", livestreamWebSocketHandler)
 	// ライブコメント投稿
-	e.POST("/api/livestream/:livestream_id/livecomment", postLivecommentHandler)
-	e.POST("/api/livestream/:livestream_id/reaction", postReactionHandler)
-	e.GET("/api/livestream/:livestream_id/reaction", getReactionsHandler)
+	writeLivecommentsAPI.POST("/livestream/:livestream_id/livecomment", postLivecommentHandler)
+	writeLivecommentsAPI.POST("/livestream/:livestream_id/reaction", postReactionHandler)
+	readLivecommentsAPI.GET("/livestream/:livestream_id/reaction", getReactionsHandler)
 
 	// (配信者向け)ライブコメントの報告一覧取得API
-	e.GET("/api/livestream/:livestream_id/report", getLivecommentReportsHandler)
-	e.GET("/api/livestream/:livestream_id/ngwords", getNgwords)
+	moderateAPI.GET("/livestream/:livestream_id/report", getLivecommentReportsHandler)
+	moderateAPI.GET("/livestream/:livestream_id/report/summary", getLivecommentReportSummaryHandler)
+	moderateAPI.POST("/livestream/:livestream_id/report/resolve", resolveLivecommentReportsHandler)
+	moderateAPI.GET("/livestream/:livestream_id/ngwords", getNgwords)
+	moderateAPI.PATCH("/livestream/:livestream_id/ngwords/:ngword_id", updateNgwordHandler)
+	moderateAPI.DELETE("/livestream/:livestream_id/ngwords/:ngword_id", deleteNgwordHandler)
 	// ライブコメント報告
-	e.POST("/api/livestream/:livestream_id/livecomment/:livecomment_id/report", reportLivecommentHandler)
+	api.POST("/livestream/:livestream_id/livecomment/:livecomment_id/report", reportLivecommentHandler)
 	// 配信者によるモデレーション (NGワード登録)
-	e.POST("/api/livestream/:livestream_id/moderate", moderateHandler)
+	moderateAPI.POST("/livestream/:livestream_id/moderate", moderateHandler)
+	// 配信者によるライブコメントの非表示と、その履歴
+	moderateAPI.POST("/livestream/:livestream_id/livecomment/:livecomment_id/hide", hideLivecommentHandler)
+	moderateAPI.GET("/livestream/:livestream_id/moderation_log", getModerationLogHandler)
+	moderateAPI.GET("/livestream/:livestream_id/moderation_settings", getModerationSettingsHandler)
+	moderateAPI.GET("/livestream/:livestream_id/bans", getLivestreamBansHandler)
+	moderateAPI.POST("/livestream/:livestream_id/bans", postLivestreamBanHandler)
+	moderateAPI.DELETE("/livestream/:livestream_id/bans/:ban_id", deleteLivestreamBanHandler)
+	moderateAPI.PATCH("/livestream/:livestream_id/moderation_settings", updateModerationSettingsHandler)
+	// 配信者のすべての配信に適用されるNGワード
+	moderateAPI.GET("/user/me/ngwords", getChannelNgwordsHandler)
+	moderateAPI.POST("/user/me/ngwords", postChannelNgwordHandler)
+	moderateAPI.POST("/user/me/ngwords/import", importNgwordListHandler)
+	// 共有NGワードリスト
+	api.GET("/ngword_lists", getNgwordListsHandler)
+	// (管理者向け)サービス全体のNGワード、共有NGワードリスト
+	adminAPI.GET("/ngwords", getGlobalNgwordsHandler)
+	adminAPI.POST("/ngwords", postGlobalNgwordHandler)
+	adminAPI.POST("/ngword_lists", postNgwordListHandler)
+	// (管理者向け)ログインのロックなどの監査ログ
+	adminAPI.GET("/audit_events", getAuditEventsHandler)
 
 	// livestream_viewersにINSERTするため必要
 	// ユーザ視聴開始 (viewer)
-	e.POST("/api/livestream/:livestream_id/enter", enterLivestreamHandler)
+	api.POST("/livestream/:livestream_id/enter", enterLivestreamHandler)
 	// ユーザ視聴終了 (viewer)
-	e.DELETE("/api/livestream/:livestream_id/exit", exitLivestreamHandler)
+	api.DELETE("/livestream/:livestream_id/exit", exitLivestreamHandler)
 
 	// user
 	e.POST("/api/register", registerHandler)
 	e.POST("/api/login", loginHandler)
-	e.GET("/api/user/me", getMeHandler)
+	api.POST("/logout", logoutHandler)
+	api.POST("/logout/all", logoutAllHandler)
+	api.GET("/user/me/sessions", getSessionsHandler)
+	api.DELETE("/user/me/sessions/:session_id", deleteSessionHandler)
+	api.PUT("/user/me/password", putPasswordHandler)
+	api.GET("/user/me/tokens", getAPITokensHandler)
+	api.POST("/user/me/tokens", postAPITokenHandler)
+	api.DELETE("/user/me/tokens/:token_id", deleteAPITokenHandler)
+	api.GET("/user/me", getMeHandler)
+	api.PATCH("/user/me", updateMeHandler)
+	api.PUT("/user/me/theme", putThemeHandler)
+	api.GET("/user/me/collaborations", getMyCollaborationsHandler)
 	// フロントエンドで、配信予約のコラボレーターを指定する際に必要
-	e.GET("/api/user/:username", getUserHandler)
-	e.GET("/api/user/:username/statistics", getUserStatisticsHandler)
+	api.GET("/user/:username", getUserHandler)
+	statsAPI.GET("/user/:username/statistics", getUserStatisticsHandler)
 	e.GET("/api/user/:username/icon", getIconHandler)
-	e.POST("/api/icon", postIconHandler)
+	api.POST("/icon", postIconHandler)
 
 	// stats
 	// ライブ配信統計情報
-	e.GET("/api/livestream/:livestream_id/statistics", getLivestreamStatisticsHandler)
+	statsAPI.GET("/livestream/:livestream_id/statistics", getLivestreamStatisticsHandler)
 
 	// 課金情報
 	e.GET("/api/payment", GetPaymentResult)
@@ -278,6 +388,11 @@ func main() {
 	defer conn.Close()
 	dbConn = conn
 
+	if err := ensureConfiguredReservationTerm(context.Background()); err != nil {
+		e.Logger.Errorf("failed to register reservation term: %v", err)
+		os.Exit(1)
+	}
+
 	subdomainAddr, ok := os.LookupEnv(powerDNSSubdomainAddressEnvKey)
 	if !ok {
 		e.Logger.Errorf("environ %s must be provided", powerDNSSubdomainAddressEnvKey)
@@ -295,10 +410,19 @@ func main() {
 
 type ErrorResponse struct {
 	Error string `json:"error"`
+	// リクエストの検証エラーの内訳
+	Details []ValidationError `json:"details,omitempty"`
 }
 
 func errorResponseHandler(err error, c echo.Context) {
 	c.Logger().Errorf("error at %s: %+v", c.Path(), err)
+	var verrs ValidationErrors
+	if errors.As(err, &verrs) {
+		if e := c.JSON(http.StatusBadRequest, &ErrorResponse{Error: "validation failed: " + verrs.Error(), Details: verrs}); e != nil {
+			c.Logger().Errorf("%+v", e)
+		}
+		return
+	}
 	if he, ok := err.(*echo.HTTPError); ok {
 		if e := c.JSON(he.Code, &ErrorResponse{Error: err.Error()}); e != nil {
 			c.Logger().Errorf("%+v", e)
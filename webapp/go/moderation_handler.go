@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// ライブコメントを非表示にした理由
+// NGワードによるものは ng_word:<NGワードのID> とする
+const (
+	hiddenReasonManual          = "manual"
+	hiddenReasonReportThreshold = "report_threshold"
+)
+
+// モデレーションログの操作
+const (
+	moderationActionHide    = "hide"
+	moderationActionRestore = "restore"
+)
+
+func hiddenReasonNGWord(ngwordID int64) string {
+	return fmt.Sprintf("ng_word:%d", ngwordID)
+}
+
+type ModerationLogModel struct {
+	ID            int64  `db:"id"`
+	LivestreamID  int64  `db:"livestream_id"`
+	LivecommentID int64  `db:"livecomment_id"`
+	ActorID       *int64 `db:"actor_id"`
+	Action        string `db:"action"`
+	Reason        string `db:"reason"`
+	CreatedAt     int64  `db:"created_at"`
+}
+
+type ModerationLog struct {
+	ID          int64       `json:"id"`
+	Livecomment Livecomment `json:"livecomment"`
+	// 自動で非表示になった場合はnull
+	Actor     *User  `json:"actor"`
+	Action    string `json:"action"`
+	Reason    string `json:"reason"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// ライブコメントを非表示にし、モデレーションログに残す
+// 非表示にしたライブコメントのIDを返す。すでに非表示のものは含まない
+// actorIDがnilならシステムによる自動の非表示
+func hideLivecomments(ctx context.Context, tx *sqlx.Tx, livestreamID int64, livecommentIDs []int64, reason string, actorID *int64) ([]int64, error) {
+	if len(livecommentIDs) == 0 {
+		return nil, nil
+	}
+
+	query, args, err := sqlx.In("SELECT id FROM livecomments WHERE livestream_id = ? AND id IN (?) AND hidden_at IS NULL FOR UPDATE", livestreamID, livecommentIDs)
+	if err != nil {
+		return nil, err
+	}
+	var targetIDs []int64
+	if err := tx.SelectContext(ctx, &targetIDs, query, args...); err != nil {
+		return nil, err
+	}
+	if len(targetIDs) == 0 {
+		return nil, nil
+	}
+
+	now := time.Now().Unix()
+	query, args, err = sqlx.In("UPDATE livecomments SET hidden_at = ?, hidden_reason = ?, hidden_by = ? WHERE id IN (?)", now, reason, actorID, targetIDs)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return nil, err
+	}
+
+	logs := make([]ModerationLogModel, len(targetIDs))
+	for i, id := range targetIDs {
+		logs[i] = ModerationLogModel{
+			LivestreamID:  livestreamID,
+			LivecommentID: id,
+			ActorID:       actorID,
+			Action:        moderationActionHide,
+			Reason:        reason,
+			CreatedAt:     now,
+		}
+	}
+	if _, err := tx.NamedExecContext(ctx, "INSERT INTO moderation_logs (livestream_id, livecomment_id, actor_id, action, reason, created_at) VALUES (:livestream_id, :livecomment_id, :actor_id, :action, :reason, :created_at)", logs); err != nil {
+		return nil, err
+	}
+
+	return targetIDs, nil
+}
+
+// 非表示にしていたライブコメントを再表示し、モデレーションログに残す
+// reasonには再表示のきっかけとなった理由を渡す
+func restoreLivecomments(ctx context.Context, tx *sqlx.Tx, livestreamID int64, livecommentIDs []int64, reason string, actorID *int64) error {
+	if len(livecommentIDs) == 0 {
+		return nil
+	}
+
+	query, args, err := sqlx.In("UPDATE livecomments SET hidden_at = NULL, hidden_reason = NULL, hidden_by = NULL WHERE livestream_id = ? AND id IN (?)", livestreamID, livecommentIDs)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	logs := make([]ModerationLogModel, len(livecommentIDs))
+	for i, id := range livecommentIDs {
+		logs[i] = ModerationLogModel{
+			LivestreamID:  livestreamID,
+			LivecommentID: id,
+			ActorID:       actorID,
+			Action:        moderationActionRestore,
+			Reason:        reason,
+			CreatedAt:     now,
+		}
+	}
+	if _, err := tx.NamedExecContext(ctx, "INSERT INTO moderation_logs (livestream_id, livecomment_id, actor_id, action, reason, created_at) VALUES (:livestream_id, :livecomment_id, :actor_id, :action, :reason, :created_at)", logs); err != nil {
+		return err
+	}
+	return nil
+}
+
+// 非表示にしたライブコメントの変更をキャッシュと購読者に反映する
+func publishHiddenLivecomments(livestreamID int64, livecommentIDs []int64) {
+	if len(livecommentIDs) == 0 {
+		return
+	}
+	LivecommentCache.Remove(fmt.Sprintf("%d", livestreamID))
+	for _, id := range livecommentIDs {
+		LivestreamEventHub.Publish(livestreamID, livestreamEventLivecommentDeleted, LivecommentDeletedEvent{ID: id})
+	}
+}
+
+// (配信者向け)ライブコメントを手動で非表示にする
+// POST /api/livestream/:livestream_id/livecomment/:livecomment_id/hide
+func hideLivecommentHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := getAuthUserID(c)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	livecommentID, err := strconv.Atoi(c.Param("livecomment_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livecomment_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if _, err := getModeratableLivestream(ctx, tx, int64(livestreamID), userID); err != nil {
+		return err
+	}
+
+	var livecommentModel LivecommentModel
+	if err := tx.GetContext(ctx, &livecommentModel, "SELECT * FROM livecomments WHERE id = ? AND livestream_id = ?", livecommentID, livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livecomment not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment: "+err.Error())
+	}
+	if livecommentModel.HiddenAt != nil {
+		return echo.NewHTTPError(http.StatusConflict, "livecomment is already hidden")
+	}
+
+	hiddenIDs, err := hideLivecomments(ctx, tx, int64(livestreamID), []int64{livecommentModel.ID}, hiddenReasonManual, &userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to hide livecomment: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	publishHiddenLivecomments(int64(livestreamID), hiddenIDs)
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// (配信者向け)モデレーションログの取得
+// GET /api/livestream/:livestream_id/moderation_log
+func getModerationLogHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := getAuthUserID(c)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	pageReq, err := parsePageRequest(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if _, err := getModeratableLivestream(ctx, tx, int64(livestreamID), userID); err != nil {
+		return err
+	}
+
+	query := "SELECT * FROM moderation_logs WHERE livestream_id = ?"
+	args := []any{livestreamID}
+	if cond, condArgs := pageReq.Where("created_at", "id"); cond != "" {
+		query += " AND " + cond
+		args = append(args, condArgs...)
+	}
+	query += pageReq.OrderByAndLimit("created_at", "id")
+
+	var logModels []ModerationLogModel
+	if err := tx.SelectContext(ctx, &logModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get moderation logs: "+err.Error())
+	}
+
+	logs := make([]ModerationLog, len(logModels))
+	for i := range logModels {
+		log, err := fillModerationLogResponse(ctx, tx, logModels[i])
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill moderation log: "+err.Error())
+		}
+		logs[i] = log
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, newPage(pageReq, logs, func(log ModerationLog) pageCursor {
+		return pageCursor{Key: log.CreatedAt, ID: log.ID}
+	}))
+}
+
+// 配信者またはコラボレーターとしてモデレーションできる配信を取得する
+// 返すエラーはecho.NewHTTPErrorなのでそのまま出力してよい
+func getModeratableLivestream(ctx context.Context, tx *sqlx.Tx, livestreamID, userID int64) (LivestreamModel, error) {
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return LivestreamModel{}, echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return LivestreamModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	canModerate, err := canModerateLivestream(ctx, tx, livestreamModel, userID)
+	if err != nil {
+		return LivestreamModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to check collaborators: "+err.Error())
+	}
+	if !canModerate {
+		return LivestreamModel{}, echo.NewHTTPError(http.StatusForbidden, "can't moderate other streamer's livestream")
+	}
+	return livestreamModel, nil
+}
+
+func fillModerationLogResponse(ctx context.Context, tx *sqlx.Tx, logModel ModerationLogModel) (ModerationLog, error) {
+	var livecommentModel LivecommentModel
+	if err := tx.GetContext(ctx, &livecommentModel, "SELECT * FROM livecomments WHERE id = ?", logModel.LivecommentID); err != nil {
+		return ModerationLog{}, err
+	}
+	livecomment, err := fillLivecommentResponse(ctx, tx, livecommentModel)
+	if err != nil {
+		return ModerationLog{}, err
+	}
+
+	var actor *User
+	if logModel.ActorID != nil {
+		var actorModel UserModel
+		if err := tx.GetContext(ctx, &actorModel, "SELECT * FROM users WHERE id = ?", *logModel.ActorID); err != nil {
+			return ModerationLog{}, err
+		}
+		user, err := fillUserResponse(ctx, tx, actorModel)
+		if err != nil {
+			return ModerationLog{}, err
+		}
+		actor = &user
+	}
+
+	return ModerationLog{
+		ID:          logModel.ID,
+		Livecomment: livecomment,
+		Actor:       actor,
+		Action:      logModel.Action,
+		Reason:      logModel.Reason,
+		CreatedAt:   logModel.CreatedAt,
+	}, nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// 0なら報告数による自動非表示をしない
+	defaultReportThreshold     = 0
+	defaultReportWindowSeconds = 10 * 60
+
+	maxReportThreshold     = 1000
+	maxReportWindowSeconds = 7 * 24 * 60 * 60
+	maxSlowModeSeconds     = 60 * 60
+)
+
+type LivestreamModerationSettingsModel struct {
+	LivestreamID        int64 `db:"livestream_id"`
+	ReportThreshold     int64 `db:"report_threshold"`
+	ReportWindowSeconds int64 `db:"report_window_seconds"`
+	SlowModeSeconds     int64 `db:"slow_mode_seconds"`
+	UpdatedAt           int64 `db:"updated_at"`
+}
+
+type LivestreamModerationSettings struct {
+	// 直近report_window_seconds秒間にこの人数から報告されたライブコメントを自動で非表示にする
+	// 0なら自動で非表示にしない
+	ReportThreshold     int64 `json:"report_threshold"`
+	ReportWindowSeconds int64 `json:"report_window_seconds"`
+	// スローモード: 視聴者はこの秒数に1回だけコメントできる。0なら無効
+	SlowModeSeconds int64 `json:"slow_mode_seconds"`
+}
+
+// 指定されなかった項目は変更しない
+type UpdateModerationSettingsRequest struct {
+	ReportThreshold     *int64 `json:"report_threshold"`
+	ReportWindowSeconds *int64 `json:"report_window_seconds"`
+	SlowModeSeconds     *int64 `json:"slow_mode_seconds"`
+}
+
+// 配信のモデレーション設定を取得する。未設定なら既定値を返す
+func getModerationSettings(ctx context.Context, tx *sqlx.Tx, livestreamID int64) (LivestreamModerationSettingsModel, error) {
+	var settings LivestreamModerationSettingsModel
+	if err := tx.GetContext(ctx, &settings, "SELECT * FROM livestream_moderation_settings WHERE livestream_id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return LivestreamModerationSettingsModel{
+				LivestreamID:        livestreamID,
+				ReportThreshold:     defaultReportThreshold,
+				ReportWindowSeconds: defaultReportWindowSeconds,
+			}, nil
+		}
+		return LivestreamModerationSettingsModel{}, err
+	}
+	return settings, nil
+}
+
+// (配信者向け)モデレーション設定の取得
+// GET /api/livestream/:livestream_id/moderation_settings
+func getModerationSettingsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := getAuthUserID(c)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if _, err := getModeratableLivestream(ctx, tx, int64(livestreamID), userID); err != nil {
+		return err
+	}
+
+	settingsModel, err := getModerationSettings(ctx, tx, int64(livestreamID))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get moderation settings: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, fillModerationSettingsResponse(settingsModel))
+}
+
+// (配信者向け)モデレーション設定の変更
+// PATCH /api/livestream/:livestream_id/moderation_settings
+func updateModerationSettingsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	userID := getAuthUserID(c)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var req *UpdateModerationSettingsRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "request body must be a json object")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't change other streamer's moderation settings")
+	}
+
+	settingsModel, err := getModerationSettings(ctx, tx, livestreamModel.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get moderation settings: "+err.Error())
+	}
+	if req.ReportThreshold != nil {
+		if *req.ReportThreshold < 0 || *req.ReportThreshold > maxReportThreshold {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("report_threshold must be between 0 and %d", maxReportThreshold))
+		}
+		settingsModel.ReportThreshold = *req.ReportThreshold
+	}
+	if req.ReportWindowSeconds != nil {
+		if *req.ReportWindowSeconds < 1 || *req.ReportWindowSeconds > maxReportWindowSeconds {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("report_window_seconds must be between 1 and %d", maxReportWindowSeconds))
+		}
+		settingsModel.ReportWindowSeconds = *req.ReportWindowSeconds
+	}
+	if req.SlowModeSeconds != nil {
+		if *req.SlowModeSeconds < 0 || *req.SlowModeSeconds > maxSlowModeSeconds {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("slow_mode_seconds must be between 0 and %d", maxSlowModeSeconds))
+		}
+		settingsModel.SlowModeSeconds = *req.SlowModeSeconds
+	}
+	settingsModel.UpdatedAt = time.Now().Unix()
+
+	if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_moderation_settings (livestream_id, report_threshold, report_window_seconds, slow_mode_seconds, updated_at) VALUES (:livestream_id, :report_threshold, :report_window_seconds, :slow_mode_seconds, :updated_at) ON DUPLICATE KEY UPDATE report_threshold = VALUES(report_threshold), report_window_seconds = VALUES(report_window_seconds), slow_mode_seconds = VALUES(slow_mode_seconds), updated_at = VALUES(updated_at)", &settingsModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update moderation settings: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, fillModerationSettingsResponse(settingsModel))
+}
+
+func fillModerationSettingsResponse(settingsModel LivestreamModerationSettingsModel) LivestreamModerationSettings {
+	return LivestreamModerationSettings{
+		ReportThreshold:     settingsModel.ReportThreshold,
+		ReportWindowSeconds: settingsModel.ReportWindowSeconds,
+		SlowModeSeconds:     settingsModel.SlowModeSeconds,
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// NGワードの変更リクエスト
+// 指定されなかった項目は変更しない
+type UpdateNGWordRequest struct {
+	NGWord    *string `json:"ng_word"`
+	MatchType *string `json:"match_type"`
+}
+
+type UpdateNGWordResponse struct {
+	NGWord                 *NGWord `json:"ng_word"`
+	HiddenLivecommentIDs   []int64 `json:"hidden_livecomment_ids"`
+	RestoredLivecommentIDs []int64 `json:"restored_livecomment_ids"`
+}
+
+type DeleteNGWordResponse struct {
+	RestoredLivecommentIDs []int64 `json:"restored_livecomment_ids"`
+}
+
+// (配信者向け)NGワードの変更
+// 変更後のNGワードに一致する表示中のライブコメントを非表示にし、
+// 変更前のNGワードで非表示になっていたライブコメントのうち、どのNGワードにも一致しなくなったものを再表示する
+// PATCH /api/livestream/:livestream_id/ngwords/:ngword_id
+func updateNgwordHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	userID := getAuthUserID(c)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	ngwordID, err := strconv.Atoi(c.Param("ngword_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "ngword_id in path must be integer")
+	}
+
+	var req UpdateNGWordRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, ngword, err := getOwnedNGWordForUpdate(ctx, tx, int64(livestreamID), int64(ngwordID), userID)
+	if err != nil {
+		return err
+	}
+
+	if req.NGWord != nil {
+		ngword.Word = *req.NGWord
+	}
+	if req.MatchType != nil {
+		ngword.MatchType = *req.MatchType
+	}
+	if err := validateNGWordRule(ngword.MatchType, ngword.Word); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if _, err := tx.NamedExecContext(ctx, "UPDATE ng_words SET word = :word, match_type = :match_type WHERE id = :id", ngword); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update NG word: "+err.Error())
+	}
+
+	// 変更後のNGワードを含めてマッチャーを作り直し、moderateと同じく照合し直す
+	matcher, err := buildNGWordMatcher(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
+	}
+	hiddenLivecommentIDs, err := hideLivecommentsMatchingNGWords(ctx, tx, livestreamModel.ID, matcher, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to hide livecomments that hit spams: "+err.Error())
+	}
+	restored, err := restoreLivecommentsHiddenByNGWord(ctx, tx, livestreamModel, matcher, ngword.ID, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to restore livecomments: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	invalidateNGWordMatcher(livestreamModel.ID)
+	publishHiddenLivecomments(livestreamModel.ID, hiddenLivecommentIDs)
+	publishRestoredLivecomments(livestreamModel.ID, restored)
+
+	if hiddenLivecommentIDs == nil {
+		hiddenLivecommentIDs = []int64{}
+	}
+	return c.JSON(http.StatusOK, UpdateNGWordResponse{
+		NGWord:                 ngword,
+		HiddenLivecommentIDs:   hiddenLivecommentIDs,
+		RestoredLivecommentIDs: livecommentIDs(restored),
+	})
+}
+
+// (配信者向け)NGワードの削除
+// ?restore=true なら、このNGワードによって非表示になったライブコメントのうち
+// 残りのNGワードに一致しないものを再表示する
+// DELETE /api/livestream/:livestream_id/ngwords/:ngword_id
+func deleteNgwordHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := getAuthUserID(c)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	ngwordID, err := strconv.Atoi(c.Param("ngword_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "ngword_id in path must be integer")
+	}
+
+	restore := false
+	if v := c.QueryParam("restore"); v != "" {
+		restore, err = strconv.ParseBool(v)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "restore query parameter must be boolean")
+		}
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, ngword, err := getOwnedNGWordForUpdate(ctx, tx, int64(livestreamID), int64(ngwordID), userID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM ng_words WHERE id = ?", ngword.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete NG word: "+err.Error())
+	}
+
+	var restored []Livecomment
+	if restore {
+		matcher, err := buildNGWordMatcher(ctx, tx, livestreamModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
+		}
+		restored, err = restoreLivecommentsHiddenByNGWord(ctx, tx, livestreamModel, matcher, ngword.ID, userID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to restore livecomments: "+err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	invalidateNGWordMatcher(livestreamModel.ID)
+	publishRestoredLivecomments(livestreamModel.ID, restored)
+
+	return c.JSON(http.StatusOK, DeleteNGWordResponse{
+		RestoredLivecommentIDs: livecommentIDs(restored),
+	})
+}
+
+// 配信者自身の配信に登録したNGワードを、更新のためにロックして取得する
+// 返すエラーはecho.NewHTTPErrorなのでそのまま出力してよい
+func getOwnedNGWordForUpdate(ctx context.Context, tx *sqlx.Tx, livestreamID, ngwordID, userID int64) (LivestreamModel, *NGWord, error) {
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return LivestreamModel{}, nil, echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return LivestreamModel{}, nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return LivestreamModel{}, nil, echo.NewHTTPError(http.StatusForbidden, "can't modify other streamer's NG words")
+	}
+
+	var ngword NGWord
+	if err := tx.GetContext(ctx, &ngword, "SELECT * FROM ng_words WHERE id = ? AND scope = ? AND livestream_id = ? FOR UPDATE", ngwordID, ngWordScopeLivestream, livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return LivestreamModel{}, nil, echo.NewHTTPError(http.StatusNotFound, "NG word not found")
+		}
+		return LivestreamModel{}, nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG word: "+err.Error())
+	}
+
+	return livestreamModel, &ngword, nil
+}
+
+// NGワードによって非表示になったライブコメントを、現在のNGワードのマッチャーで照合し直す
+// どれにも一致しなければ再表示し、別のNGワードに一致すれば非表示の理由をそちらに付け替える
+func restoreLivecommentsHiddenByNGWord(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, matcher *ngWordMatcher, ngwordID int64, actorID int64) ([]Livecomment, error) {
+	reason := hiddenReasonNGWord(ngwordID)
+
+	var hiddenModels []LivecommentModel
+	if err := tx.SelectContext(ctx, &hiddenModels, "SELECT * FROM livecomments WHERE livestream_id = ? AND hidden_reason = ? FOR UPDATE", livestreamModel.ID, reason); err != nil {
+		return nil, err
+	}
+	if len(hiddenModels) == 0 {
+		return nil, nil
+	}
+
+	var restoreIDs []int64
+	var restoredModels []LivecommentModel
+	for _, lc := range hiddenModels {
+		if ngword, ok := matcher.Match(lc.Comment); ok {
+			if ngword.ID == ngwordID {
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, "UPDATE livecomments SET hidden_reason = ? WHERE id = ?", hiddenReasonNGWord(ngword.ID), lc.ID); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		restoreIDs = append(restoreIDs, lc.ID)
+		restoredModels = append(restoredModels, lc)
+	}
+
+	if err := restoreLivecomments(ctx, tx, livestreamModel.ID, restoreIDs, reason, &actorID); err != nil {
+		return nil, err
+	}
+
+	restored := make([]Livecomment, len(restoredModels))
+	for i := range restoredModels {
+		livecomment, err := fillLivecommentResponse(ctx, tx, restoredModels[i])
+		if err != nil {
+			return nil, err
+		}
+		restored[i] = livecomment
+	}
+	return restored, nil
+}
+
+func publishRestoredLivecomments(livestreamID int64, restored []Livecomment) {
+	if len(restored) == 0 {
+		return
+	}
+	LivecommentCache.Remove(fmt.Sprintf("%d", livestreamID))
+	for _, livecomment := range restored {
+		LivestreamEventHub.Publish(livestreamID, livestreamEventLivecommentRestored, livecomment)
+	}
+}
+
+func livecommentIDs(livecomments []Livecomment) []int64 {
+	ids := make([]int64, len(livecomments))
+	for i := range livecomments {
+		ids[i] = livecomments[i].ID
+	}
+	return ids
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// NGワードの適用範囲
+const (
+	// 1つの配信のみ (moderateで登録したもの)
+	ngWordScopeLivestream = "livestream"
+	// 配信者のすべての配信
+	ngWordScopeChannel = "channel"
+	// サービス全体 (管理者が登録したもの)
+	ngWordScopeGlobal = "global"
+	// 共有リストの中身。取り込まれるまではどの配信にも適用されない
+	ngWordScopeShared = "shared"
+)
+
+// 管理者が用意する、配信者が取り込めるNGワードのリスト
+type NGWordListModel struct {
+	ID        int64  `db:"id"`
+	Name      string `db:"name"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+type NGWordList struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Words     []*NGWord `json:"words"`
+	CreatedAt int64     `json:"created_at"`
+}
+
+type PostNGWordListRequest struct {
+	Name  string            `json:"name"`
+	Words []ModerateRequest `json:"words"`
+}
+
+type ImportNGWordListRequest struct {
+	ListID int64 `json:"list_id"`
+}
+
+// 配信者のすべての配信に適用されるNGワードの一覧
+// GET /api/user/me/ngwords
+func getChannelNgwordsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := getAuthUserID(c)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	ngWords := []*NGWord{}
+	if err := tx.SelectContext(ctx, &ngWords, "SELECT * FROM ng_words WHERE scope = ? AND user_id = ? ORDER BY created_at DESC", ngWordScopeChannel, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, ngWords)
+}
+
+// 配信者のすべての配信に適用されるNGワードの登録
+// 登録済みのコメントは削除しない
+// POST /api/user/me/ngwords
+func postChannelNgwordHandler(c echo.Context) error {
+	defer c.Request().Body.Close()
+
+	userID := getAuthUserID(c)
+
+	var req *ModerateRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "request body must be a json object")
+	}
+
+	return postScopedNgword(c, req, &NGWord{
+		UserID: userID,
+		Scope:  ngWordScopeChannel,
+	})
+}
+
+// (管理者向け)サービス全体に適用されるNGワードの一覧
+// GET /api/admin/ngwords
+func getGlobalNgwordsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	ngWords := []*NGWord{}
+	if err := tx.SelectContext(ctx, &ngWords, "SELECT * FROM ng_words WHERE scope = ? ORDER BY created_at DESC", ngWordScopeGlobal); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, ngWords)
+}
+
+// (管理者向け)サービス全体に適用されるNGワードの登録
+// POST /api/admin/ngwords
+func postGlobalNgwordHandler(c echo.Context) error {
+	defer c.Request().Body.Close()
+
+	var req *ModerateRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "request body must be a json object")
+	}
+
+	return postScopedNgword(c, req, &NGWord{
+		Scope: ngWordScopeGlobal,
+	})
+}
+
+func postScopedNgword(c echo.Context, req *ModerateRequest, ngword *NGWord) error {
+	ctx := c.Request().Context()
+
+	if req.MatchType == "" {
+		req.MatchType = ngWordMatchLiteral
+	}
+	if err := validateNGWordRule(req.MatchType, req.NGWord); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	ngword.Word = req.NGWord
+	ngword.MatchType = req.MatchType
+	ngword.CreatedAt = time.Now().Unix()
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	wordID, err := insertNGWord(ctx, tx, ngword)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert new NG word: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// 複数の配信のマッチャーに影響するので作り直させる
+	invalidateAllNGWordMatchers()
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"word_id": wordID,
+	})
+}
+
+// 共有NGワードリストの一覧
+// GET /api/ngword_lists
+func getNgwordListsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var listModels []NGWordListModel
+	if err := tx.SelectContext(ctx, &listModels, "SELECT * FROM ng_word_lists ORDER BY id"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG word lists: "+err.Error())
+	}
+
+	lists := make([]NGWordList, len(listModels))
+	for i := range listModels {
+		list, err := fillNGWordListResponse(ctx, tx, listModels[i])
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill NG word list: "+err.Error())
+		}
+		lists[i] = list
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, lists)
+}
+
+// (管理者向け)共有NGワードリストの作成
+// POST /api/admin/ngword_lists
+func postNgwordListHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	var req *PostNGWordListRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "request body must be a json object")
+	}
+	if req.Name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name is required")
+	}
+	for i := range req.Words {
+		if req.Words[i].MatchType == "" {
+			req.Words[i].MatchType = ngWordMatchLiteral
+		}
+		if err := validateNGWordRule(req.Words[i].MatchType, req.Words[i].NGWord); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("words[%d]: %s", i, err.Error()))
+		}
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	listModel := NGWordListModel{
+		Name:      req.Name,
+		CreatedAt: now,
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO ng_word_lists (name, created_at) VALUES (:name, :created_at)", listModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert NG word list: "+err.Error())
+	}
+	listID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted NG word list id: "+err.Error())
+	}
+	listModel.ID = listID
+
+	for _, w := range req.Words {
+		if _, err := insertNGWord(ctx, tx, &NGWord{
+			Word:      w.NGWord,
+			MatchType: w.MatchType,
+			Scope:     ngWordScopeShared,
+			ListID:    &listID,
+			CreatedAt: now,
+		}); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert new NG word: "+err.Error())
+		}
+	}
+
+	list, err := fillNGWordListResponse(ctx, tx, listModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill NG word list: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, list)
+}
+
+// 共有NGワードリストを、配信者のすべての配信に適用されるNGワードとして取り込む
+// 取り込み済みのNGワードは重複して登録しない
+// POST /api/user/me/ngwords/import
+func importNgwordListHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	userID := getAuthUserID(c)
+
+	var req *ImportNGWordListRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "request body must be a json object")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var listModel NGWordListModel
+	if err := tx.GetContext(ctx, &listModel, "SELECT * FROM ng_word_lists WHERE id = ?", req.ListID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "NG word list not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG word list: "+err.Error())
+	}
+
+	var sharedWords []*NGWord
+	if err := tx.SelectContext(ctx, &sharedWords, "SELECT * FROM ng_words WHERE scope = ? AND list_id = ?", ngWordScopeShared, listModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
+	}
+
+	now := time.Now().Unix()
+	imported := 0
+	for _, w := range sharedWords {
+		var exists int
+		if err := tx.GetContext(ctx, &exists, "SELECT COUNT(*) FROM ng_words WHERE scope = ? AND user_id = ? AND word = ? AND match_type = ?", ngWordScopeChannel, userID, w.Word, w.MatchType); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
+		}
+		if exists > 0 {
+			continue
+		}
+		if _, err := insertNGWord(ctx, tx, &NGWord{
+			UserID:    userID,
+			Word:      w.Word,
+			MatchType: w.MatchType,
+			Scope:     ngWordScopeChannel,
+			ListID:    &listModel.ID,
+			CreatedAt: now,
+		}); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert new NG word: "+err.Error())
+		}
+		imported++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	invalidateAllNGWordMatchers()
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"imported": imported,
+	})
+}
+
+func insertNGWord(ctx context.Context, tx *sqlx.Tx, ngword *NGWord) (int64, error) {
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO ng_words(user_id, livestream_id, word, match_type, scope, list_id, created_at) VALUES (:user_id, :livestream_id, :word, :match_type, :scope, :list_id, :created_at)", ngword)
+	if err != nil {
+		return 0, err
+	}
+	return rs.LastInsertId()
+}
+
+func fillNGWordListResponse(ctx context.Context, tx *sqlx.Tx, listModel NGWordListModel) (NGWordList, error) {
+	words := []*NGWord{}
+	if err := tx.SelectContext(ctx, &words, "SELECT * FROM ng_words WHERE scope = ? AND list_id = ? ORDER BY id", ngWordScopeShared, listModel.ID); err != nil {
+		return NGWordList{}, err
+	}
+	return NGWordList{
+		ID:        listModel.ID,
+		Name:      listModel.Name,
+		Words:     words,
+		CreatedAt: listModel.CreatedAt,
+	}, nil
+}
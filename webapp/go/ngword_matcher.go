@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// NGワードの種類
+const (
+	// 部分一致
+	ngWordMatchLiteral = "literal"
+	// 単語単位での一致 (前後が文字・数字でない)
+	ngWordMatchWholeWord = "whole_word"
+	// 正規表現 (RE2なので入力長に比例した時間で照合できる)
+	ngWordMatchRegex = "regex"
+	// * は任意の文字列、? は任意の1文字
+	ngWordMatchWildcard = "wildcard"
+)
+
+const maxNGWordPatternLength = 255
+
+// NGワードの照合に使う正規化
+// NFKC正規化、大文字小文字の同一視、カタカナをひらがなに寄せる、空白・不可視文字の除去を行う
+// keepSpacesがtrueなら空白は除去せず、連続する空白を1つにまとめる
+func normalizeNGWordText(s string, keepSpaces bool) string {
+	s = cases.Fold().String(norm.NFKC.String(s))
+
+	var b strings.Builder
+	b.Grow(len(s))
+	pendingSpace := false
+	for _, r := range s {
+		if unicode.IsSpace(r) {
+			pendingSpace = true
+			continue
+		}
+		if unicode.Is(unicode.Cf, r) {
+			// ゼロ幅スペースなど
+			continue
+		}
+		if pendingSpace && keepSpaces && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		pendingSpace = false
+		b.WriteRune(foldKana(r))
+	}
+	return b.String()
+}
+
+// カタカナをひらがなに寄せる
+func foldKana(r rune) rune {
+	if r >= 'ァ' && r <= 'ヶ' {
+		return r - ('ァ' - 'ぁ')
+	}
+	return r
+}
+
+// NGワードの種類と内容を検証する
+func validateNGWordRule(matchType, word string) error {
+	if utf8.RuneCountInString(word) > maxNGWordPatternLength {
+		return fmt.Errorf("ng_word must be at most %d characters", maxNGWordPatternLength)
+	}
+	switch matchType {
+	case ngWordMatchLiteral, ngWordMatchWholeWord, ngWordMatchWildcard:
+		if normalizeNGWordText(strings.NewReplacer("*", "", "?", "").Replace(word), false) == "" {
+			return fmt.Errorf("ng_word must not be empty")
+		}
+	case ngWordMatchRegex:
+		if word == "" {
+			return fmt.Errorf("ng_word must not be empty")
+		}
+	default:
+		return fmt.Errorf("match_type must be one of %s, %s, %s or %s", ngWordMatchLiteral, ngWordMatchWholeWord, ngWordMatchRegex, ngWordMatchWildcard)
+	}
+	if matchType == ngWordMatchLiteral {
+		return nil
+	}
+	re, _, err := compileNGWordPattern(matchType, word)
+	if err != nil {
+		return fmt.Errorf("invalid ng_word pattern: %w", err)
+	}
+	if re.MatchString("") {
+		// すべてのコメントに一致してしまう
+		return fmt.Errorf("ng_word pattern must not match an empty comment")
+	}
+	return nil
+}
+
+// literal以外のNGワードを正規表現にする
+// 2つ目の戻り値は、空白を残して正規化したコメントに対して照合するかどうか
+func compileNGWordPattern(matchType, word string) (*regexp.Regexp, bool, error) {
+	switch matchType {
+	case ngWordMatchWholeWord:
+		w := regexp.QuoteMeta(normalizeNGWordText(word, true))
+		re, err := regexp.Compile(`(?:^|[^\pL\pN_])` + w + `(?:$|[^\pL\pN_])`)
+		return re, true, err
+	case ngWordMatchWildcard:
+		var b strings.Builder
+		b.WriteString("(?s)")
+		for _, r := range normalizeNGWordText(word, false) {
+			switch r {
+			case '*':
+				b.WriteString(".*")
+			case '?':
+				b.WriteString(".")
+			default:
+				b.WriteString(regexp.QuoteMeta(string(r)))
+			}
+		}
+		re, err := regexp.Compile(b.String())
+		return re, false, err
+	case ngWordMatchRegex:
+		// 構文は崩さないよう、空白の除去や大文字小文字の変換はせず(?i)で扱う
+		pattern := strings.Map(foldKana, norm.NFKC.String(word))
+		re, err := regexp.Compile("(?i)" + pattern)
+		return re, false, err
+	default:
+		return nil, false, fmt.Errorf("unknown match_type %q", matchType)
+	}
+}
+
+// 配信に登録されたNGワードをまとめて照合する
+// literalはAho-Corasickで一度に、それ以外は正規表現で照合する
+type ngWordMatcher struct {
+	literals     *ahoCorasick
+	literalWords []*NGWord
+	patterns     []ngWordPattern
+}
+
+type ngWordPattern struct {
+	re         *regexp.Regexp
+	keepSpaces bool
+	word       *NGWord
+}
+
+func newNGWordMatcher(words []*NGWord) *ngWordMatcher {
+	m := &ngWordMatcher{}
+	var literals []string
+	for _, w := range words {
+		matchType := w.MatchType
+		if matchType == "" {
+			matchType = ngWordMatchLiteral
+		}
+		if matchType == ngWordMatchLiteral {
+			if normalized := normalizeNGWordText(w.Word, false); normalized != "" {
+				literals = append(literals, normalized)
+				m.literalWords = append(m.literalWords, w)
+			}
+			continue
+		}
+		re, keepSpaces, err := compileNGWordPattern(matchType, w.Word)
+		if err != nil {
+			// 登録時に検証しているので、ここで失敗したものは無視する
+			continue
+		}
+		m.patterns = append(m.patterns, ngWordPattern{re: re, keepSpaces: keepSpaces, word: w})
+	}
+	m.literals = newAhoCorasick(literals)
+	return m
+}
+
+// textに含まれるNGワードを1つ返す
+func (m *ngWordMatcher) Match(text string) (*NGWord, bool) {
+	compact := normalizeNGWordText(text, false)
+	if i, ok := m.literals.Match(compact); ok {
+		return m.literalWords[i], true
+	}
+
+	var spaced string
+	for _, p := range m.patterns {
+		target := compact
+		if p.keepSpaces {
+			if spaced == "" {
+				spaced = normalizeNGWordText(text, true)
+			}
+			target = spaced
+		}
+		if p.re.MatchString(target) {
+			return p.word, true
+		}
+	}
+	return nil, false
+}
+
+// Aho-Corasickオートマトン
+// 文字列長に比例した時間で、登録されたすべてのパターンとの照合を一度に行う
+type ahoCorasick struct {
+	nodes []ahoCorasickNode
+}
+
+type ahoCorasickNode struct {
+	next map[byte]int32
+	fail int32
+	// このノードで終わるパターンの位置。なければ-1
+	pattern int32
+	// failを辿って最初に見つかる、パターンで終わるノード。なければ-1
+	output int32
+}
+
+func newAhoCorasick(patterns []string) *ahoCorasick {
+	a := &ahoCorasick{
+		nodes: []ahoCorasickNode{{fail: 0, pattern: -1, output: -1}},
+	}
+
+	// トライ木の構築
+	for i, p := range patterns {
+		if p == "" {
+			continue
+		}
+		cur := int32(0)
+		for j := 0; j < len(p); j++ {
+			b := p[j]
+			next, ok := a.nodes[cur].next[b]
+			if !ok {
+				next = int32(len(a.nodes))
+				a.nodes = append(a.nodes, ahoCorasickNode{pattern: -1, output: -1})
+				if a.nodes[cur].next == nil {
+					a.nodes[cur].next = make(map[byte]int32)
+				}
+				a.nodes[cur].next[b] = next
+			}
+			cur = next
+		}
+		if a.nodes[cur].pattern < 0 {
+			a.nodes[cur].pattern = int32(i)
+		}
+	}
+
+	// 幅優先でfailリンクを張る
+	queue := make([]int32, 0, len(a.nodes))
+	for _, child := range a.nodes[0].next {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for b, child := range a.nodes[cur].next {
+			fail := a.nodes[cur].fail
+			for {
+				if next, ok := a.nodes[fail].next[b]; ok && next != child {
+					a.nodes[child].fail = next
+					break
+				}
+				if fail == 0 {
+					a.nodes[child].fail = 0
+					break
+				}
+				fail = a.nodes[fail].fail
+			}
+			f := a.nodes[child].fail
+			if a.nodes[f].pattern >= 0 {
+				a.nodes[child].output = f
+			} else {
+				a.nodes[child].output = a.nodes[f].output
+			}
+			queue = append(queue, child)
+		}
+	}
+
+	return a
+}
+
+// textに含まれるパターンを1つ見つけ、その位置を返す
+func (a *ahoCorasick) Match(text string) (int, bool) {
+	cur := int32(0)
+	for i := 0; i < len(text); i++ {
+		b := text[i]
+		for {
+			if next, ok := a.nodes[cur].next[b]; ok {
+				cur = next
+				break
+			}
+			if cur == 0 {
+				break
+			}
+			cur = a.nodes[cur].fail
+		}
+		if p := a.nodes[cur].pattern; p >= 0 {
+			return int(p), true
+		}
+		if out := a.nodes[cur].output; out >= 0 {
+			return int(a.nodes[out].pattern), true
+		}
+	}
+	return 0, false
+}
+
+func ngWordMatcherCacheKey(livestreamID int64) string {
+	return fmt.Sprintf("%d", livestreamID)
+}
+
+// 配信に適用されるNGワード
+// 配信ごと、配信者のすべての配信、サービス全体のものをまとめて新しい順に返す
+func selectLivestreamNGWords(ctx context.Context, tx *sqlx.Tx, ownerID, livestreamID int64) ([]*NGWord, error) {
+	ngwords := []*NGWord{}
+	query := "SELECT * FROM ng_words WHERE (scope = ? AND user_id = ? AND livestream_id = ?) OR (scope = ? AND user_id = ?) OR scope = ? ORDER BY created_at DESC"
+	if err := tx.SelectContext(ctx, &ngwords, query, ngWordScopeLivestream, ownerID, livestreamID, ngWordScopeChannel, ownerID, ngWordScopeGlobal); err != nil {
+		return nil, err
+	}
+	return ngwords, nil
+}
+
+// 配信のNGワードからマッチャーを構築する
+func buildNGWordMatcher(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel) (*ngWordMatcher, error) {
+	ngwords, err := selectLivestreamNGWords(ctx, tx, livestreamModel.UserID, livestreamModel.ID)
+	if err != nil {
+		return nil, err
+	}
+	return newNGWordMatcher(ngwords), nil
+}
+
+// NGWordMatcherCacheの世代。NGワードを変更したらコミット後に進める
+// 古いスナップショットから構築したマッチャーが、変更後にキャッシュされるのを防ぐ
+var ngWordMatcherGeneration struct {
+	sync.Mutex
+	n uint64
+}
+
+// 現在の世代。getNGWordMatcherに渡すため、トランザクションを始める前に取得する
+func currentNGWordMatcherGeneration() uint64 {
+	ngWordMatcherGeneration.Lock()
+	defer ngWordMatcherGeneration.Unlock()
+	return ngWordMatcherGeneration.n
+}
+
+// 配信のマッチャーを破棄する。NGワードを変更したトランザクションのコミット後に呼ぶ
+func invalidateNGWordMatcher(livestreamID int64) {
+	ngWordMatcherGeneration.Lock()
+	defer ngWordMatcherGeneration.Unlock()
+	ngWordMatcherGeneration.n++
+	NGWordMatcherCache.Remove(ngWordMatcherCacheKey(livestreamID))
+}
+
+// 複数の配信に影響する変更では、すべてのマッチャーを破棄する
+func invalidateAllNGWordMatchers() {
+	ngWordMatcherGeneration.Lock()
+	defer ngWordMatcherGeneration.Unlock()
+	ngWordMatcherGeneration.n++
+	NGWordMatcherCache.Purge()
+}
+
+// キャッシュにあればそれを、なければ構築してキャッシュする
+// generationはtxを始める前に取得した世代で、その後にNGワードが変更されていれば構築したものはキャッシュしない
+func getNGWordMatcher(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, generation uint64) (*ngWordMatcher, error) {
+	key := ngWordMatcherCacheKey(livestreamModel.ID)
+	if v, ok := NGWordMatcherCache.Get(key); ok {
+		if m, ok := v.(*ngWordMatcher); ok {
+			return m, nil
+		}
+	}
+
+	m, err := buildNGWordMatcher(ctx, tx, livestreamModel)
+	if err != nil {
+		return nil, err
+	}
+
+	ngWordMatcherGeneration.Lock()
+	defer ngWordMatcherGeneration.Unlock()
+	if ngWordMatcherGeneration.n == generation {
+		NGWordMatcherCache.Add(key, m)
+	}
+	return m, nil
+}
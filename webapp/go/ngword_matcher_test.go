@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeNGWordText(t *testing.T) {
+	tests := []struct {
+		name       string
+		in         string
+		keepSpaces bool
+		want       string
+	}{
+		{name: "全角英数字はNFKCで半角になる", in: "ＳＰＡＭ１２３", want: "spam123"},
+		{name: "半角カナはNFKCで全角になりひらがなに寄る", in: "ｽﾊﾟﾑ", want: "すぱむ"},
+		{name: "大文字小文字を同一視する", in: "SpAm", want: "spam"},
+		{name: "カタカナはひらがなに寄る", in: "スパム", want: "すぱむ"},
+		{name: "長音記号はそのまま", in: "ゲーム", want: "げーむ"},
+		{name: "ゼロ幅スペースを除く", in: "sp\u200bam", want: "spam"},
+		{name: "空白を除く", in: " s p\tam ", want: "spam"},
+		{name: "keepSpacesなら連続する空白を1つにまとめる", in: "  foo \t bar  ", keepSpaces: true, want: "foo bar"},
+		{name: "全角空白も空白として扱う", in: "foo　bar", keepSpaces: true, want: "foo bar"},
+		{name: "ドイツ語のßは大文字小文字の同一視でssになる", in: "STRASSE straße", want: "strassestrasse"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeNGWordText(tt.in, tt.keepSpaces); got != tt.want {
+				t.Errorf("normalizeNGWordText(%q, %v) = %q, want %q", tt.in, tt.keepSpaces, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNGWordMatcherLiteral(t *testing.T) {
+	words := []*NGWord{
+		{ID: 1, Word: "spam", MatchType: ngWordMatchLiteral},
+		{ID: 2, Word: "バカ", MatchType: ngWordMatchLiteral},
+		// match_typeが空なら部分一致として扱う
+		{ID: 3, Word: "ＮＧ"},
+	}
+	m := newNGWordMatcher(words)
+
+	tests := []struct {
+		comment string
+		wantID  int64
+	}{
+		{comment: "this is SPAM!", wantID: 1},
+		{comment: "ｓｐａｍ", wantID: 1},
+		{comment: "s p a m", wantID: 1},
+		{comment: "ばか", wantID: 2},
+		{comment: "ﾊﾞｶ", wantID: 2},
+		{comment: "ng", wantID: 3},
+		{comment: "hello", wantID: 0},
+		{comment: "", wantID: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.comment, func(t *testing.T) {
+			assertNGWordMatch(t, m, tt.comment, tt.wantID)
+		})
+	}
+}
+
+func TestNGWordMatcherPatterns(t *testing.T) {
+	words := []*NGWord{
+		{ID: 1, Word: "ass", MatchType: ngWordMatchWholeWord},
+		{ID: 2, Word: "b*d", MatchType: ngWordMatchWildcard},
+		{ID: 3, Word: "c?t", MatchType: ngWordMatchWildcard},
+		{ID: 4, Word: `^\d{3}-\d{4}$`, MatchType: ngWordMatchRegex},
+		{ID: 5, Word: "ハゲ+", MatchType: ngWordMatchRegex},
+	}
+	m := newNGWordMatcher(words)
+
+	tests := []struct {
+		name    string
+		comment string
+		wantID  int64
+	}{
+		{name: "単語単位で一致する", comment: "you ass!", wantID: 1},
+		{name: "大文字でも単語単位で一致する", comment: "ASS", wantID: 1},
+		{name: "単語の一部には一致しない", comment: "classic grass", wantID: 0},
+		{name: "*は任意の文字列", comment: "bread", wantID: 2},
+		{name: "*は空文字列にも一致する", comment: "bd", wantID: 2},
+		{name: "?は任意の1文字", comment: "cat", wantID: 3},
+		{name: "?は0文字には一致しない", comment: "ct", wantID: 0},
+		{name: "?は2文字には一致しない", comment: "coat", wantID: 0},
+		{name: "正規表現は正規化したコメントに照合する", comment: "１２３-４５６７", wantID: 4},
+		{name: "正規表現のアンカーは全体に効く", comment: "tel 123-4567", wantID: 0},
+		{name: "正規表現のカタカナはひらがなに寄せて照合する", comment: "はげげげ", wantID: 5},
+		{name: "正規表現は大文字小文字を区別しない", comment: "ﾊｹﾞ", wantID: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertNGWordMatch(t, m, tt.comment, tt.wantID)
+		})
+	}
+}
+
+func TestValidateNGWordRule(t *testing.T) {
+	tests := []struct {
+		name      string
+		matchType string
+		word      string
+		wantErr   bool
+	}{
+		{name: "literal", matchType: ngWordMatchLiteral, word: "spam"},
+		{name: "空のliteral", matchType: ngWordMatchLiteral, word: " \u200b ", wantErr: true},
+		{name: "wildcard", matchType: ngWordMatchWildcard, word: "sp*m"},
+		{name: "記号だけのwildcard", matchType: ngWordMatchWildcard, word: "*?*", wantErr: true},
+		{name: "regex", matchType: ngWordMatchRegex, word: "sp[a4]m"},
+		{name: "構文エラーのregex", matchType: ngWordMatchRegex, word: "sp(am", wantErr: true},
+		{name: "空文字列に一致するregex", matchType: ngWordMatchRegex, word: "a*", wantErr: true},
+		{name: "不明な種類", matchType: "glob", word: "spam", wantErr: true},
+		{name: "長すぎる", matchType: ngWordMatchLiteral, word: strings.Repeat("a", maxNGWordPatternLength+1), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateNGWordRule(tt.matchType, tt.word)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateNGWordRule(%q, %q) = %v, wantErr %v", tt.matchType, tt.word, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAhoCorasickOverlappingPatterns(t *testing.T) {
+	a := newAhoCorasick([]string{"he", "she", "hers", "his"})
+	tests := []struct {
+		text   string
+		wantOK bool
+	}{
+		{text: "ushers", wantOK: true},
+		{text: "ahishers", wantOK: true},
+		{text: "xhxsx", wantOK: false},
+		{text: "h", wantOK: false},
+	}
+	for _, tt := range tests {
+		if _, ok := a.Match(tt.text); ok != tt.wantOK {
+			t.Errorf("Match(%q) = %v, want %v", tt.text, ok, tt.wantOK)
+		}
+	}
+}
+
+func assertNGWordMatch(t *testing.T, m *ngWordMatcher, comment string, wantID int64) {
+	t.Helper()
+	w, ok := m.Match(comment)
+	switch {
+	case wantID == 0 && ok:
+		t.Errorf("Match(%q) matched %q, want no match", comment, w.Word)
+	case wantID != 0 && !ok:
+		t.Errorf("Match(%q) did not match, want id=%d", comment, wantID)
+	case wantID != 0 && w.ID != wantID:
+		t.Errorf("Match(%q) matched id=%d, want id=%d", comment, w.ID, wantID)
+	}
+}
+
+// 以前の実装と同じく、NGワードを1つずつ部分一致で照合する
+func matchNGWordsOneByOne(words []*NGWord, comment string) bool {
+	for _, w := range words {
+		if strings.Contains(comment, w.Word) {
+			return true
+		}
+	}
+	return false
+}
+
+func BenchmarkNGWordMatcher(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	randomWord := func(n int) string {
+		const letters = "abcdefghijklmnopqrstuvwxyzあいうえおかきくけこ"
+		runes := []rune(letters)
+		var sb strings.Builder
+		for i := 0; i < n; i++ {
+			sb.WriteRune(runes[r.Intn(len(runes))])
+		}
+		return sb.String()
+	}
+
+	for _, numWords := range []int{10, 100, 1000} {
+		words := make([]*NGWord, numWords)
+		for i := range words {
+			// 正規化で変化しない文字だけを使い、どちらの実装でも同じ結果になるようにする
+			words[i] = &NGWord{ID: int64(i + 1), Word: "ng" + randomWord(6), MatchType: ngWordMatchLiteral}
+		}
+		m := newNGWordMatcher(words)
+
+		for _, commentLength := range []int{16, 128, 1024} {
+			// NGワードを含まないコメントは、すべてのNGワードと照合することになる最悪のケース
+			comment := randomWord(commentLength)
+
+			b.Run(fmt.Sprintf("one_by_one/words=%d/len=%d", numWords, commentLength), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					matchNGWordsOneByOne(words, normalizeNGWordText(comment, false))
+				}
+			})
+			b.Run(fmt.Sprintf("aho_corasick/words=%d/len=%d", numWords, commentLength), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					m.Match(comment)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 100
+)
+
+// 一覧APIのページング位置
+// クライアントには中身を見せず、base64でエンコードした文字列として渡す
+type pageCursor struct {
+	// 並び順のキー (created_at など)
+	Key int64 `json:"k"`
+	ID  int64 `json:"i"`
+}
+
+func (cur pageCursor) String() string {
+	b, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodePageCursor(s string) (pageCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return pageCursor{}, err
+	}
+	var cur pageCursor
+	if err := json.Unmarshal(b, &cur); err != nil {
+		return pageCursor{}, err
+	}
+	return cur, nil
+}
+
+// 一覧APIのレスポンス
+type Page[T any] struct {
+	Items      []T    `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+func emptyPage[T any]() Page[T] {
+	return Page[T]{Items: []T{}}
+}
+
+// 一覧APIのページング指定
+// before: カーソルより古いものを新しい順に返す (デフォルト)
+// after:  カーソルより新しいものを古い順に返す
+type pageRequest struct {
+	Limit  int
+	Before *pageCursor
+	After  *pageCursor
+}
+
+func parsePageRequest(c echo.Context) (pageRequest, error) {
+	req := pageRequest{
+		Limit: defaultPageSize,
+	}
+
+	if v := c.QueryParam("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil {
+			return pageRequest{}, echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
+		}
+		if limit < 1 {
+			return pageRequest{}, echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be positive")
+		}
+		req.Limit = min(limit, maxPageSize)
+	}
+
+	if v := c.QueryParam("before"); v != "" {
+		cur, err := decodePageCursor(v)
+		if err != nil {
+			return pageRequest{}, echo.NewHTTPError(http.StatusBadRequest, "invalid before cursor")
+		}
+		req.Before = &cur
+	}
+	if v := c.QueryParam("after"); v != "" {
+		cur, err := decodePageCursor(v)
+		if err != nil {
+			return pageRequest{}, echo.NewHTTPError(http.StatusBadRequest, "invalid after cursor")
+		}
+		req.After = &cur
+	}
+	if req.Before != nil && req.After != nil {
+		return pageRequest{}, echo.NewHTTPError(http.StatusBadRequest, "before and after cannot be specified at the same time")
+	}
+
+	return req, nil
+}
+
+// 先頭ページ(キャッシュ可能なページ)かどうか
+func (p pageRequest) IsFirstPage() bool {
+	return p.Before == nil && p.After == nil && p.Limit == defaultPageSize
+}
+
+func (p pageRequest) CacheKey() string {
+	var before, after string
+	if p.Before != nil {
+		before = p.Before.String()
+	}
+	if p.After != nil {
+		after = p.After.String()
+	}
+	return fmt.Sprintf("limit=%d&before=%s&after=%s", p.Limit, before, after)
+}
+
+// カーソル位置の条件。条件がなければ空文字を返す
+func (p pageRequest) Where(keyColumn, idColumn string) (string, []any) {
+	return p.where(keyColumn, idColumn, false)
+}
+
+// 並び順とLIMIT句
+// 次ページの有無を判定するため、1件多く取得する
+func (p pageRequest) OrderByAndLimit(keyColumn, idColumn string) string {
+	return p.orderByAndLimit(keyColumn, idColumn, false)
+}
+
+// キーの昇順に並べる一覧向けのWhere
+// before は昇順の続き、after は逆向きになる
+func (p pageRequest) WhereAsc(keyColumn, idColumn string) (string, []any) {
+	return p.where(keyColumn, idColumn, true)
+}
+
+// キーの昇順に並べる一覧向けのOrderByAndLimit
+func (p pageRequest) OrderByAndLimitAsc(keyColumn, idColumn string) string {
+	return p.orderByAndLimit(keyColumn, idColumn, true)
+}
+
+func (p pageRequest) where(keyColumn, idColumn string, asc bool) (string, []any) {
+	var cur *pageCursor
+	op := "<"
+	switch {
+	case p.Before != nil:
+		cur = p.Before
+	case p.After != nil:
+		cur = p.After
+		op = ">"
+	default:
+		return "", nil
+	}
+	if asc {
+		if op == "<" {
+			op = ">"
+		} else {
+			op = "<"
+		}
+	}
+	return fmt.Sprintf("(%s %s ? OR (%s = ? AND %s %s ?))", keyColumn, op, keyColumn, idColumn, op), []any{cur.Key, cur.Key, cur.ID}
+}
+
+func (p pageRequest) orderByAndLimit(keyColumn, idColumn string, asc bool) string {
+	// afterなら逆順に並べる
+	desc := !asc
+	if p.After != nil {
+		desc = !desc
+	}
+	order := "ASC"
+	if desc {
+		order = "DESC"
+	}
+	return fmt.Sprintf(" ORDER BY %s %s, %s %s LIMIT %d", keyColumn, order, idColumn, order, p.Limit+1)
+}
+
+// Limit+1件取得した結果からページを組み立てる
+func newPage[T any](p pageRequest, items []T, cursorOf func(T) pageCursor) Page[T] {
+	hasMore := len(items) > p.Limit
+	if hasMore {
+		items = items[:p.Limit]
+	}
+
+	page := Page[T]{Items: items}
+	if page.Items == nil {
+		page.Items = []T{}
+	}
+
+	switch {
+	case p.After != nil:
+		// 新着を追いかけられるよう、afterでは常に次のカーソルを返す
+		if len(items) > 0 {
+			page.NextCursor = cursorOf(items[len(items)-1]).String()
+		} else {
+			page.NextCursor = p.After.String()
+		}
+	case hasMore:
+		page.NextCursor = cursorOf(items[len(items)-1]).String()
+	}
+
+	return page
+}
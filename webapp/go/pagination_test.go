@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestPageRequestWhereAndOrderBy(t *testing.T) {
+	cur := &pageCursor{Key: 100, ID: 7}
+	tests := []struct {
+		name      string
+		req       pageRequest
+		asc       bool
+		wantWhere string
+		wantOrder string
+	}{
+		{
+			name:      "指定なしは新しい順",
+			req:       pageRequest{Limit: 10},
+			wantOrder: " ORDER BY created_at DESC, id DESC LIMIT 11",
+		},
+		{
+			name:      "beforeはカーソルより古いものを新しい順",
+			req:       pageRequest{Limit: 10, Before: cur},
+			wantWhere: "(created_at < ? OR (created_at = ? AND id < ?))",
+			wantOrder: " ORDER BY created_at DESC, id DESC LIMIT 11",
+		},
+		{
+			name:      "afterはカーソルより新しいものを古い順",
+			req:       pageRequest{Limit: 10, After: cur},
+			wantWhere: "(created_at > ? OR (created_at = ? AND id > ?))",
+			wantOrder: " ORDER BY created_at ASC, id ASC LIMIT 11",
+		},
+		{
+			name:      "昇順の一覧で指定なしは古い順",
+			req:       pageRequest{Limit: 10},
+			asc:       true,
+			wantOrder: " ORDER BY created_at ASC, id ASC LIMIT 11",
+		},
+		{
+			name:      "昇順の一覧でbeforeは昇順の続き",
+			req:       pageRequest{Limit: 10, Before: cur},
+			asc:       true,
+			wantWhere: "(created_at > ? OR (created_at = ? AND id > ?))",
+			wantOrder: " ORDER BY created_at ASC, id ASC LIMIT 11",
+		},
+		{
+			name:      "昇順の一覧でafterは逆向き",
+			req:       pageRequest{Limit: 10, After: cur},
+			asc:       true,
+			wantWhere: "(created_at < ? OR (created_at = ? AND id < ?))",
+			wantOrder: " ORDER BY created_at DESC, id DESC LIMIT 11",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			where, args := tt.req.Where("created_at", "id")
+			order := tt.req.OrderByAndLimit("created_at", "id")
+			if tt.asc {
+				where, args = tt.req.WhereAsc("created_at", "id")
+				order = tt.req.OrderByAndLimitAsc("created_at", "id")
+			}
+
+			if where != tt.wantWhere {
+				t.Errorf("where = %q, want %q", where, tt.wantWhere)
+			}
+			wantArgs := []any{}
+			if tt.wantWhere != "" {
+				wantArgs = []any{cur.Key, cur.Key, cur.ID}
+			}
+			if !slices.Equal(args, wantArgs) {
+				t.Errorf("args = %v, want %v", args, wantArgs)
+			}
+			if order != tt.wantOrder {
+				t.Errorf("order = %q, want %q", order, tt.wantOrder)
+			}
+		})
+	}
+}
+
+func TestNewPage(t *testing.T) {
+	cursorOf := func(n int64) pageCursor { return pageCursor{Key: n, ID: n} }
+
+	t.Run("続きがあれば最後の要素のカーソルを返す", func(t *testing.T) {
+		page := newPage(pageRequest{Limit: 2}, []int64{3, 2, 1}, cursorOf)
+		if !slices.Equal(page.Items, []int64{3, 2}) || page.NextCursor != cursorOf(2).String() {
+			t.Errorf("got %+v", page)
+		}
+	})
+	t.Run("続きがなければカーソルを返さない", func(t *testing.T) {
+		page := newPage(pageRequest{Limit: 2}, []int64{2, 1}, cursorOf)
+		if !slices.Equal(page.Items, []int64{2, 1}) || page.NextCursor != "" {
+			t.Errorf("got %+v", page)
+		}
+	})
+	t.Run("空でもitemsはnullにしない", func(t *testing.T) {
+		page := newPage[int64](pageRequest{Limit: 2}, nil, cursorOf)
+		if page.Items == nil || len(page.Items) != 0 {
+			t.Errorf("got %+v", page)
+		}
+	})
+	t.Run("afterでは新着がなくても同じカーソルを返す", func(t *testing.T) {
+		after := cursorOf(5)
+		page := newPage(pageRequest{Limit: 2, After: &after}, []int64{}, cursorOf)
+		if page.NextCursor != after.String() {
+			t.Errorf("got %+v, want next cursor %q", page, after.String())
+		}
+		page = newPage(pageRequest{Limit: 2, After: &after}, []int64{6}, cursorOf)
+		if page.NextCursor != cursorOf(6).String() {
+			t.Errorf("got %+v, want next cursor %q", page, cursorOf(6).String())
+		}
+	})
+}
+
+func TestParsePageRequest(t *testing.T) {
+	cur := pageCursor{Key: 100, ID: 7}
+	tests := []struct {
+		name      string
+		query     string
+		want      pageRequest
+		wantError bool
+	}{
+		{name: "既定", query: "", want: pageRequest{Limit: defaultPageSize}},
+		{name: "limitは上限で切り詰める", query: "?limit=1000", want: pageRequest{Limit: maxPageSize}},
+		{name: "limitが0", query: "?limit=0", wantError: true},
+		{name: "limitが数値でない", query: "?limit=abc", wantError: true},
+		{name: "before", query: "?before=" + cur.String(), want: pageRequest{Limit: defaultPageSize, Before: &cur}},
+		{name: "after", query: "?after=" + cur.String(), want: pageRequest{Limit: defaultPageSize, After: &cur}},
+		{name: "壊れたカーソル", query: "?before=!!", wantError: true},
+		{name: "beforeとafterの同時指定", query: "?before=" + cur.String() + "&after=" + cur.String(), wantError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/"+tt.query, nil), httptest.NewRecorder())
+			got, err := parsePageRequest(c)
+			if tt.wantError {
+				var he *echo.HTTPError
+				if !errors.As(err, &he) || he.Code != http.StatusBadRequest {
+					t.Fatalf("parsePageRequest(%q) error = %v, want 400", tt.query, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsePageRequest(%q) error = %v", tt.query, err)
+			}
+			if got.Limit != tt.want.Limit || !equalCursor(got.Before, tt.want.Before) || !equalCursor(got.After, tt.want.After) {
+				t.Errorf("parsePageRequest(%q) = %+v, want %+v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func equalCursor(a, b *pageCursor) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	passwordMinLengthEnvKey       = "ISUCON13_PASSWORD_MIN_LENGTH"
+	passwordRequiredClassesEnvKey = "ISUCON13_PASSWORD_REQUIRED_CLASSES"
+	passwordHashEnvKey            = "ISUCON13_PASSWORD_HASH"
+	bcryptCostEnvKey              = "ISUCON13_BCRYPT_COST"
+
+	passwordHashBcrypt   = "bcrypt"
+	passwordHashArgon2id = "argon2id"
+
+	maxPasswordLength = 128
+	// bcryptは72バイトを超えるパスワードを扱えない
+	maxBcryptPasswordBytes = 72
+
+	argon2idTime     = 3
+	argon2idMemory   = 64 * 1024
+	argon2idThreads  = 4
+	argon2idKeyLen   = 32
+	argon2idSaltSize = 16
+)
+
+var errUnknownPasswordHash = errors.New("unknown password hash format")
+
+// 環境変数で設定される、パスワードの要件とハッシュ方式
+// 未設定の場合は空でない任意のパスワードを受け付け、bcrypt (DefaultCost) でハッシュする
+type passwordConfig struct {
+	MinLength int
+	// 英大文字・英小文字・数字・記号のうち、含まなければならない種類の数
+	RequiredClasses int
+	Hash            string
+	BcryptCost      int
+}
+
+var passwordConf = passwordConfig{
+	MinLength:       1,
+	RequiredClasses: 0,
+	Hash:            passwordHashBcrypt,
+	BcryptCost:      bcryptDefaultCost,
+}
+
+func loadPasswordConfig() error {
+	if v, ok := os.LookupEnv(passwordMinLengthEnvKey); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as integer: %+v", passwordMinLengthEnvKey, err)
+		}
+		if n < 1 || n > maxPasswordLength {
+			return fmt.Errorf("environment variable '%s' must be between 1 and %d", passwordMinLengthEnvKey, maxPasswordLength)
+		}
+		passwordConf.MinLength = n
+	}
+	if v, ok := os.LookupEnv(passwordRequiredClassesEnvKey); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as integer: %+v", passwordRequiredClassesEnvKey, err)
+		}
+		if n < 0 || n > 4 {
+			return fmt.Errorf("environment variable '%s' must be between 0 and 4", passwordRequiredClassesEnvKey)
+		}
+		passwordConf.RequiredClasses = n
+	}
+	switch v := os.Getenv(passwordHashEnvKey); v {
+	case "", passwordHashBcrypt:
+		passwordConf.Hash = passwordHashBcrypt
+	case passwordHashArgon2id:
+		passwordConf.Hash = passwordHashArgon2id
+	default:
+		return fmt.Errorf("environment variable '%s' must be bcrypt or argon2id: %s", passwordHashEnvKey, v)
+	}
+	if v, ok := os.LookupEnv(bcryptCostEnvKey); ok {
+		cost, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as integer: %+v", bcryptCostEnvKey, err)
+		}
+		if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+			return fmt.Errorf("environment variable '%s' must be between %d and %d", bcryptCostEnvKey, bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		passwordConf.BcryptCost = cost
+	}
+	return nil
+}
+
+// パスワードが要件を満たしているか検証する
+func validatePassword(field, password string) error {
+	var errs ValidationErrors
+
+	length := utf8.RuneCountInString(password)
+	switch {
+	case password == "":
+		errs = append(errs, ValidationError{Field: field, Code: validationCodeRequired, Message: field + " must not be empty"})
+	case length < passwordConf.MinLength:
+		errs = append(errs, ValidationError{Field: field, Code: validationCodeTooShort, Message: fmt.Sprintf("%s must be at least %d characters", field, passwordConf.MinLength)})
+	case length > maxPasswordLength:
+		errs = append(errs, ValidationError{Field: field, Code: validationCodeTooLong, Message: fmt.Sprintf("%s must be at most %d characters", field, maxPasswordLength)})
+	case passwordConf.Hash == passwordHashBcrypt && len(password) > maxBcryptPasswordBytes:
+		errs = append(errs, ValidationError{Field: field, Code: validationCodeTooLong, Message: fmt.Sprintf("%s must be at most %d bytes", field, maxBcryptPasswordBytes)})
+	case passwordCharacterClasses(password) < passwordConf.RequiredClasses:
+		errs = append(errs, ValidationError{Field: field, Code: validationCodeTooWeak, Message: fmt.Sprintf("%s must contain at least %d of uppercase letters, lowercase letters, digits and symbols", field, passwordConf.RequiredClasses)})
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// 英大文字・英小文字・数字・記号のうち、含まれている種類の数
+func passwordCharacterClasses(password string) int {
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	n := 0
+	for _, ok := range []bool{upper, lower, digit, symbol} {
+		if ok {
+			n++
+		}
+	}
+	return n
+}
+
+// 設定されている方式でパスワードをハッシュする
+func hashPassword(password string) (string, error) {
+	if passwordConf.Hash == passwordHashArgon2id {
+		salt := make([]byte, argon2idSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, argon2idTime, argon2idMemory, argon2idThreads, argon2idKeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, argon2idMemory, argon2idTime, argon2idThreads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key),
+		), nil
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), passwordConf.BcryptCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashed), nil
+}
+
+// 存在しないユーザ名でのログインでも照合にかかる時間を揃えるための、設定された方式でのハッシュ
+var dummyPasswordHash = sync.OnceValues(func() (string, error) {
+	return hashPassword("dummy password")
+})
+
+// ハッシュの形式を判別してパスワードを照合する
+func comparePassword(hash, password string) (bool, error) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		params, salt, key, err := parseArgon2idHash(hash)
+		if err != nil {
+			return false, err
+		}
+		other := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// 保存されているハッシュが、設定されている方式・強度より弱いか
+// ログイン時にパスワードを照合できた後で、ハッシュし直すかの判断に使う
+func passwordNeedsRehash(hash string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		if passwordConf.Hash != passwordHashArgon2id {
+			return true
+		}
+		params, _, _, err := parseArgon2idHash(hash)
+		if err != nil {
+			return true
+		}
+		return params.time < argon2idTime || params.memory < argon2idMemory
+	}
+
+	if passwordConf.Hash != passwordHashBcrypt {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return true
+	}
+	return cost < passwordConf.BcryptCost
+}
+
+type argon2idParams struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+}
+
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key> の形式のハッシュを分解する
+func parseArgon2idHash(hash string) (argon2idParams, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != passwordHashArgon2id {
+		return argon2idParams{}, nil, nil, errUnknownPasswordHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return argon2idParams{}, nil, nil, errUnknownPasswordHash
+	}
+
+	var params argon2idParams
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil || params.time < 1 || params.threads < 1 {
+		return argon2idParams{}, nil, nil, errUnknownPasswordHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return argon2idParams{}, nil, nil, errUnknownPasswordHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return argon2idParams{}, nil, nil, errUnknownPasswordHash
+	}
+
+	return params, salt, key, nil
+}
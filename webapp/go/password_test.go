@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// テストの間だけパスワードの設定を差し替える
+func setPasswordConfig(t *testing.T, conf passwordConfig) {
+	t.Helper()
+	orig := passwordConf
+	passwordConf = conf
+	t.Cleanup(func() { passwordConf = orig })
+}
+
+func TestValidatePassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		conf     passwordConfig
+		password string
+		wantCode string
+	}{
+		{name: "既定では1文字でもよい", conf: passwordConfig{MinLength: 1, Hash: passwordHashBcrypt}, password: "a"},
+		{name: "空は不可", conf: passwordConfig{MinLength: 1, Hash: passwordHashBcrypt}, password: "", wantCode: validationCodeRequired},
+		{name: "最短の長さは文字数で数える", conf: passwordConfig{MinLength: 4, Hash: passwordHashBcrypt}, password: "あいうえ"},
+		{name: "最短の長さに満たない", conf: passwordConfig{MinLength: 8, Hash: passwordHashBcrypt}, password: "short", wantCode: validationCodeTooShort},
+		{name: "最長を超える", conf: passwordConfig{MinLength: 1, Hash: passwordHashArgon2id}, password: strings.Repeat("a", maxPasswordLength+1), wantCode: validationCodeTooLong},
+		{name: "bcryptでは72バイトを超えられない", conf: passwordConfig{MinLength: 1, Hash: passwordHashBcrypt}, password: strings.Repeat("あ", 25), wantCode: validationCodeTooLong},
+		{name: "argon2idなら72バイトを超えてもよい", conf: passwordConfig{MinLength: 1, Hash: passwordHashArgon2id}, password: strings.Repeat("あ", 25)},
+		{name: "文字種が足りない", conf: passwordConfig{MinLength: 1, RequiredClasses: 3, Hash: passwordHashBcrypt}, password: "password1", wantCode: validationCodeTooWeak},
+		{name: "文字種が足りる", conf: passwordConfig{MinLength: 1, RequiredClasses: 3, Hash: passwordHashBcrypt}, password: "Password1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setPasswordConfig(t, tt.conf)
+
+			err := validatePassword("password", tt.password)
+			if tt.wantCode == "" {
+				if err != nil {
+					t.Fatalf("validatePassword(%q) = %v, want nil", tt.password, err)
+				}
+				return
+			}
+			var verrs ValidationErrors
+			if !errors.As(err, &verrs) || len(verrs) != 1 || verrs[0].Code != tt.wantCode || verrs[0].Field != "password" {
+				t.Fatalf("validatePassword(%q) = %v, want a single %s error on password", tt.password, err, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestPasswordCharacterClasses(t *testing.T) {
+	tests := []struct {
+		password string
+		want     int
+	}{
+		{password: "", want: 0},
+		{password: "abc", want: 1},
+		{password: "abcABC", want: 2},
+		{password: "abcABC123", want: 3},
+		{password: "abcABC123!", want: 4},
+		// 英字以外の文字は記号として数える
+		{password: "パスワード", want: 1},
+	}
+	for _, tt := range tests {
+		if got := passwordCharacterClasses(tt.password); got != tt.want {
+			t.Errorf("passwordCharacterClasses(%q) = %d, want %d", tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestHashAndComparePassword(t *testing.T) {
+	for _, hash := range []string{passwordHashBcrypt, passwordHashArgon2id} {
+		t.Run(hash, func(t *testing.T) {
+			setPasswordConfig(t, passwordConfig{MinLength: 1, Hash: hash, BcryptCost: bcrypt.MinCost})
+
+			hashed, err := hashPassword("correct horse")
+			if err != nil {
+				t.Fatalf("hashPassword: %v", err)
+			}
+			if ok, err := comparePassword(hashed, "correct horse"); err != nil || !ok {
+				t.Errorf("comparePassword with the right password = %v, %v, want true", ok, err)
+			}
+			if ok, err := comparePassword(hashed, "wrong horse"); err != nil || ok {
+				t.Errorf("comparePassword with a wrong password = %v, %v, want false", ok, err)
+			}
+			if passwordNeedsRehash(hashed) {
+				t.Errorf("passwordNeedsRehash(%q) = true for a hash made with the current config", hashed)
+			}
+		})
+	}
+}
+
+func TestPasswordNeedsRehash(t *testing.T) {
+	setPasswordConfig(t, passwordConfig{MinLength: 1, Hash: passwordHashBcrypt, BcryptCost: bcrypt.MinCost})
+	weak, err := hashPassword("password")
+	if err != nil {
+		t.Fatalf("hashPassword: %v", err)
+	}
+
+	// コストを上げたら、それより弱いハッシュはハッシュし直す
+	passwordConf.BcryptCost = bcrypt.MinCost + 1
+	if !passwordNeedsRehash(weak) {
+		t.Errorf("passwordNeedsRehash = false for a bcrypt hash weaker than the configured cost")
+	}
+
+	// 方式を変えたら、以前の方式のハッシュはハッシュし直す
+	passwordConf.Hash = passwordHashArgon2id
+	if !passwordNeedsRehash(weak) {
+		t.Errorf("passwordNeedsRehash = false for a bcrypt hash while argon2id is configured")
+	}
+
+	if !passwordNeedsRehash("$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5") {
+		t.Errorf("passwordNeedsRehash = false for an argon2id hash weaker than the configured parameters")
+	}
+}
+
+func TestParseArgon2idHash(t *testing.T) {
+	tests := []struct {
+		name    string
+		hash    string
+		wantErr bool
+	}{
+		{name: "正しい形式", hash: "$argon2id$v=19$m=65536,t=3,p=4$c2FsdHNhbHQ$a2V5a2V5"},
+		{name: "バージョンが異なる", hash: "$argon2id$v=16$m=65536,t=3,p=4$c2FsdHNhbHQ$a2V5a2V5", wantErr: true},
+		{name: "方式が異なる", hash: "$argon2i$v=19$m=65536,t=3,p=4$c2FsdHNhbHQ$a2V5a2V5", wantErr: true},
+		{name: "パラメータが欠けている", hash: "$argon2id$v=19$m=65536,t=3$c2FsdHNhbHQ$a2V5a2V5", wantErr: true},
+		{name: "tが0", hash: "$argon2id$v=19$m=65536,t=0,p=4$c2FsdHNhbHQ$a2V5a2V5", wantErr: true},
+		{name: "鍵が空", hash: "$argon2id$v=19$m=65536,t=3,p=4$c2FsdHNhbHQ$", wantErr: true},
+		{name: "区切りが足りない", hash: "$argon2id$v=19$m=65536,t=3,p=4$c2FsdHNhbHQ", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, _, err := parseArgon2idHash(tt.hash)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseArgon2idHash(%q) = %v, wantErr %v", tt.hash, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	maxDisplayNameLength = 255
+	maxDescriptionLength = 2000
+)
+
+// 指定されなかった項目は変更しない
+type UpdateMeRequest struct {
+	DisplayName *string `json:"display_name"`
+	Description *string `json:"description"`
+}
+
+type PutThemeRequest struct {
+	DarkMode *bool `json:"dark_mode"`
+}
+
+// プロフィールの文字列から、表示を崩す制御文字・双方向テキストの制御文字を取り除く
+// 複数行を許す項目では改行とタブを残す
+func sanitizeProfileText(s string, multiline bool) string {
+	s = strings.Map(func(r rune) rune {
+		if multiline && (r == '\n' || r == '\t') {
+			return r
+		}
+		if unicode.Is(unicode.Cc, r) || unicode.Is(unicode.Bidi_Control, r) {
+			return -1
+		}
+		return r
+	}, s)
+	return strings.TrimSpace(s)
+}
+
+// プロフィールの変更リクエストを検証する
+// 制御文字を取り除いた値をreqに書き戻す
+func validateUpdateMeRequest(req *UpdateMeRequest) error {
+	var errs ValidationErrors
+
+	if req.DisplayName != nil {
+		displayName := sanitizeProfileText(*req.DisplayName, false)
+		req.DisplayName = &displayName
+		if displayName == "" {
+			errs = append(errs, ValidationError{Field: "display_name", Code: validationCodeRequired, Message: "display_name must not be empty"})
+		} else if utf8.RuneCountInString(displayName) > maxDisplayNameLength {
+			errs = append(errs, ValidationError{Field: "display_name", Code: validationCodeTooLong, Message: fmt.Sprintf("display_name must be at most %d characters", maxDisplayNameLength)})
+		}
+	}
+
+	if req.Description != nil {
+		description := sanitizeProfileText(*req.Description, true)
+		req.Description = &description
+		if utf8.RuneCountInString(description) > maxDescriptionLength {
+			errs = append(errs, ValidationError{Field: "description", Code: validationCodeTooLong, Message: fmt.Sprintf("description must be at most %d characters", maxDescriptionLength)})
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ユーザのプロフィールを埋め込んでいるキャッシュの範囲
+// 検索結果とライブコメントのキャッシュは、索引からユーザを含むエントリを引く
+type userCacheRefs struct {
+	UserID int64
+	// ユーザがコラボレーターとして参加している配信の配信者
+	OwnerIDs []int64
+}
+
+func getUserCacheRefs(ctx context.Context, tx *sqlx.Tx, userID int64) (userCacheRefs, error) {
+	refs := userCacheRefs{UserID: userID}
+	if err := tx.SelectContext(ctx, &refs.OwnerIDs, "SELECT DISTINCT livestreams.user_id FROM livestream_collaborators INNER JOIN livestreams ON livestreams.id = livestream_collaborators.livestream_id WHERE livestream_collaborators.user_id = ? AND livestream_collaborators.status = ?", userID, collaboratorStatusAccepted); err != nil {
+		return userCacheRefs{}, err
+	}
+	return refs, nil
+}
+
+// プロフィールの変更をコミットした後で、古いプロフィールを含むキャッシュを破棄する
+func (refs userCacheRefs) Invalidate() {
+	LivestreamCache.Remove(fmt.Sprintf("%d", refs.UserID))
+	for _, ownerID := range refs.OwnerIDs {
+		LivestreamCache.Remove(fmt.Sprintf("%d", ownerID))
+	}
+	for _, key := range searchLivestreamCacheUsers.Keys(refs.UserID) {
+		SearchLivestreamCache.Remove(key)
+	}
+	for _, key := range livecommentCacheUsers.Keys(refs.UserID) {
+		LivecommentCache.Remove(key)
+	}
+}
+
+// プロフィールの変更
+// PATCH /api/user/me
+func updateMeHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	userID := getAuthUserID(c)
+
+	var req *UpdateMeRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "request body must be a json object")
+	}
+
+	if err := validateUpdateMeRequest(req); err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	userModel := UserModel{}
+	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ? FOR UPDATE", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	if req.DisplayName != nil {
+		userModel.DisplayName = *req.DisplayName
+	}
+	if req.Description != nil {
+		userModel.Description = *req.Description
+	}
+	if _, err := tx.NamedExecContext(ctx, "UPDATE users SET display_name = :display_name, description = :description WHERE id = :id", userModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update user: "+err.Error())
+	}
+
+	refs, err := getUserCacheRefs(ctx, tx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams to refresh: "+err.Error())
+	}
+
+	user, err := fillUserResponse(ctx, tx, userModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	refs.Invalidate()
+
+	return c.JSON(http.StatusOK, user)
+}
+
+// テーマの変更
+// PUT /api/user/me/theme
+func putThemeHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	userID := getAuthUserID(c)
+
+	var req *PutThemeRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req == nil || req.DarkMode == nil {
+		return ValidationErrors{{Field: "dark_mode", Code: validationCodeRequired, Message: "dark_mode must be specified"}}
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	themeModel := ThemeModel{}
+	if err := tx.GetContext(ctx, &themeModel, "SELECT * FROM themes WHERE user_id = ? FOR UPDATE", userID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user theme: "+err.Error())
+		}
+		rs, err := tx.ExecContext(ctx, "INSERT INTO themes (user_id, dark_mode) VALUES (?, ?)", userID, *req.DarkMode)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user theme: "+err.Error())
+		}
+		themeID, err := rs.LastInsertId()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted theme id: "+err.Error())
+		}
+		themeModel = ThemeModel{ID: themeID, UserID: userID}
+	} else if _, err := tx.ExecContext(ctx, "UPDATE themes SET dark_mode = ? WHERE id = ?", *req.DarkMode, themeModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update user theme: "+err.Error())
+	}
+	themeModel.DarkMode = *req.DarkMode
+
+	refs, err := getUserCacheRefs(ctx, tx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams to refresh: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	refs.Invalidate()
+
+	return c.JSON(http.StatusOK, Theme{
+		ID:       themeModel.ID,
+		DarkMode: themeModel.DarkMode,
+	})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// トークンバケットの設定
+// Burst個まで連続して受け付け、その後は1秒あたりRate個ずつ回復する
+type RateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+var (
+	// ライブコメント
+	livecommentRateLimit = RateLimit{Rate: 1, Burst: 10}
+	// チップ付きのライブコメント。通常のコメントとは別に数え、スローモードの対象外とする
+	tippedLivecommentRateLimit = RateLimit{Rate: 2, Burst: 20}
+	// リアクション
+	reactionRateLimit = RateLimit{Rate: 2, Burst: 20}
+)
+
+// 保持するバケットの数
+// キーはログイン済みのユーザと配信の組なので、追い出して制限を外すには多数のアカウントが要る
+const rateLimiterMaxBuckets = 65536
+
+// 1つのリクエストで消費するバケット
+type RateLimitBucket struct {
+	Key   string
+	Limit RateLimit
+}
+
+// レート制限の状態を保持するストア
+type RateLimiter interface {
+	// すべてのバケットからトークンを1つずつ消費する
+	// 1つでも消費できないバケットがあれば、どのバケットからも消費せずに
+	// falseと、すべてのバケットで消費できるようになるまでの時間を返す
+	Allow(buckets []RateLimitBucket, now time.Time) (bool, time.Duration)
+	// Allowで消費したトークンを戻す
+	Refund(buckets []RateLimitBucket, now time.Time)
+	// すべての状態を破棄する
+	Reset()
+}
+
+var PostRateLimiter RateLimiter = newMemoryRateLimiter(rateLimiterMaxBuckets)
+
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// 前回の更新からの経過時間の分だけトークンを回復する
+func (b *tokenBucket) refill(limit RateLimit, now time.Time) {
+	if elapsed := now.Sub(b.updatedAt).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(limit.Burst, b.tokens+elapsed*limit.Rate)
+		b.updatedAt = now
+	}
+}
+
+// バケットをプロセス内のLRUに保持する。追い出されたバケットは満タンから数え直す
+type memoryRateLimiter struct {
+	mu      sync.Mutex
+	buckets *lru.Cache[string, *tokenBucket]
+}
+
+func newMemoryRateLimiter(size int) *memoryRateLimiter {
+	buckets, err := lru.New[string, *tokenBucket](size)
+	if err != nil {
+		panic(err)
+	}
+	return &memoryRateLimiter{buckets: buckets}
+}
+
+func (l *memoryRateLimiter) Allow(buckets []RateLimitBucket, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// すべてのバケットを確かめてから消費する
+	bs := make([]*tokenBucket, len(buckets))
+	var wait time.Duration
+	for i, bucket := range buckets {
+		b, ok := l.buckets.Get(bucket.Key)
+		if !ok {
+			b = &tokenBucket{tokens: bucket.Limit.Burst, updatedAt: now}
+			l.buckets.Add(bucket.Key, b)
+		}
+		b.refill(bucket.Limit, now)
+		if b.tokens < 1 {
+			wait = max(wait, time.Duration((1-b.tokens)/bucket.Limit.Rate*float64(time.Second)))
+		}
+		bs[i] = b
+	}
+	if wait > 0 {
+		return false, wait
+	}
+
+	for _, b := range bs {
+		b.tokens--
+	}
+	return true, 0
+}
+
+func (l *memoryRateLimiter) Refund(buckets []RateLimitBucket, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, bucket := range buckets {
+		// 溢れて捨てられたバケットは満タンから数え直すので、戻す必要はない
+		b, ok := l.buckets.Get(bucket.Key)
+		if !ok {
+			continue
+		}
+		b.refill(bucket.Limit, now)
+		b.tokens = math.Min(bucket.Limit.Burst, b.tokens+1)
+	}
+}
+
+func (l *memoryRateLimiter) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buckets.Purge()
+}
+
+func rateLimitKey(kind string, userID, livestreamID int64) string {
+	return fmt.Sprintf("%s:%d:%d", kind, userID, livestreamID)
+}
+
+// 消費したトークン
+// 受け付けなかったリクエストの分はRefundで戻す
+type rateLimitReservation struct {
+	buckets []RateLimitBucket
+}
+
+func (r rateLimitReservation) Refund() {
+	if len(r.buckets) > 0 {
+		PostRateLimiter.Refund(r.buckets, time.Now())
+	}
+}
+
+// バケットのいずれかでレート制限を超えていれば、どのバケットも消費せずにRetry-Afterを付けて429を返す
+// 返すエラーはecho.NewHTTPErrorなのでそのまま出力してよい
+func checkRateLimit(c echo.Context, buckets ...RateLimitBucket) (rateLimitReservation, error) {
+	ok, wait := PostRateLimiter.Allow(buckets, time.Now())
+	if ok {
+		return rateLimitReservation{buckets: buckets}, nil
+	}
+	retryAfter := int64(math.Ceil(wait.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	c.Response().Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	return rateLimitReservation{}, echo.NewHTTPError(http.StatusTooManyRequests, fmt.Sprintf("too many requests, retry after %d seconds", retryAfter))
+}
+
+// スローモード: N秒に1回だけ投稿できる
+func slowModeRateLimit(seconds int64) RateLimit {
+	return RateLimit{Rate: 1 / float64(seconds), Burst: 1}
+}
+
+// ライブコメントの投稿頻度を制限する
+// チップ付きのコメントは別枠で数え、スローモードは配信者とチップ付きのコメントには適用しない
+// コメントを受け付けなかった場合は、返したトークンをRefundで戻す
+// 返すエラーはecho.NewHTTPErrorなのでそのまま出力してよい
+func checkLivecommentRateLimit(ctx context.Context, c echo.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, userID int64, tip int64) (rateLimitReservation, error) {
+	if tip > 0 {
+		return checkRateLimit(c, RateLimitBucket{Key: rateLimitKey("tipped_livecomment", userID, livestreamModel.ID), Limit: tippedLivecommentRateLimit})
+	}
+
+	buckets := []RateLimitBucket{{Key: rateLimitKey("livecomment", userID, livestreamModel.ID), Limit: livecommentRateLimit}}
+	if userID != livestreamModel.UserID {
+		settings, err := getModerationSettings(ctx, tx, livestreamModel.ID)
+		if err != nil {
+			return rateLimitReservation{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get moderation settings: "+err.Error())
+		}
+		if settings.SlowModeSeconds > 0 {
+			buckets = append(buckets, RateLimitBucket{Key: rateLimitKey("slow_mode", userID, livestreamModel.ID), Limit: slowModeRateLimit(settings.SlowModeSeconds)})
+		}
+	}
+
+	return checkRateLimit(c, buckets...)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimiterBurstAndRefill(t *testing.T) {
+	l := newMemoryRateLimiter(16)
+	now := time.Unix(1700000000, 0)
+	buckets := []RateLimitBucket{{Key: "k", Limit: RateLimit{Rate: 2, Burst: 3}}}
+
+	// Burst個までは連続して消費できる
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow(buckets, now); !ok {
+			t.Fatalf("request %d: denied, want allowed", i)
+		}
+	}
+	// 空になったら、1秒あたりRate個の回復を待つ
+	ok, wait := l.Allow(buckets, now)
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("got ok=%v wait=%v, want denied with wait=500ms", ok, wait)
+	}
+
+	// 回復した分だけ消費できる
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.Allow(buckets, now); !ok {
+		t.Fatalf("after refill: denied, want allowed")
+	}
+	if ok, _ := l.Allow(buckets, now); ok {
+		t.Fatalf("after refill: allowed twice, want denied")
+	}
+
+	// 回復はBurstで頭打ちになる
+	now = now.Add(1 * time.Hour)
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow(buckets, now); !ok {
+			t.Fatalf("after long idle, request %d: denied, want allowed", i)
+		}
+	}
+	if ok, _ := l.Allow(buckets, now); ok {
+		t.Fatalf("after long idle: allowed more than burst")
+	}
+}
+
+func TestMemoryRateLimiterAllOrNothing(t *testing.T) {
+	l := newMemoryRateLimiter(16)
+	now := time.Unix(1700000000, 0)
+	general := RateLimitBucket{Key: "general", Limit: RateLimit{Rate: 1, Burst: 10}}
+	slow := RateLimitBucket{Key: "slow", Limit: slowModeRateLimit(30)}
+
+	if ok, _ := l.Allow([]RateLimitBucket{general, slow}, now); !ok {
+		t.Fatalf("first request: denied, want allowed")
+	}
+
+	// スローモードで弾かれたリクエストは、他のバケットのトークンも消費しない
+	for i := 0; i < 20; i++ {
+		ok, wait := l.Allow([]RateLimitBucket{general, slow}, now)
+		if ok || wait != 30*time.Second {
+			t.Fatalf("request %d: got ok=%v wait=%v, want denied with wait=30s", i, ok, wait)
+		}
+	}
+	for i := 0; i < 9; i++ {
+		if ok, _ := l.Allow([]RateLimitBucket{general}, now); !ok {
+			t.Fatalf("general request %d: denied, want allowed", i)
+		}
+	}
+	if ok, _ := l.Allow([]RateLimitBucket{general}, now); ok {
+		t.Fatalf("general bucket: allowed more than burst")
+	}
+}
+
+func TestMemoryRateLimiterRefund(t *testing.T) {
+	l := newMemoryRateLimiter(16)
+	now := time.Unix(1700000000, 0)
+	buckets := []RateLimitBucket{{Key: "k", Limit: slowModeRateLimit(10)}}
+
+	if ok, _ := l.Allow(buckets, now); !ok {
+		t.Fatalf("first request: denied, want allowed")
+	}
+	// 受け付けなかったリクエストの分を戻せば、すぐにまた消費できる
+	l.Refund(buckets, now)
+	if ok, _ := l.Allow(buckets, now); !ok {
+		t.Fatalf("after refund: denied, want allowed")
+	}
+
+	// 戻してもBurstを超えない
+	l.Refund(buckets, now)
+	l.Refund(buckets, now)
+	if ok, _ := l.Allow(buckets, now); !ok {
+		t.Fatalf("after double refund: denied, want allowed")
+	}
+	if ok, _ := l.Allow(buckets, now); ok {
+		t.Fatalf("after double refund: allowed more than burst")
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"time"
 
 	"github.com/jmoiron/sqlx"
-	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
 
@@ -36,11 +35,6 @@ type PostReactionRequest struct {
 func getReactionsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
-		return err
-	}
-
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
@@ -48,23 +42,27 @@ func getReactionsHandler(c echo.Context) error {
 
 	LivecommentCache.Remove(fmt.Sprintf("%d", livestreamID))
 
+	pageReq, err := parsePageRequest(c)
+	if err != nil {
+		return err
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	query := "SELECT * FROM reactions WHERE livestream_id = ? ORDER BY created_at DESC"
-	if c.QueryParam("limit") != "" {
-		limit, err := strconv.Atoi(c.QueryParam("limit"))
-		if err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
-		}
-		query += fmt.Sprintf(" LIMIT %d", limit)
+	query := "SELECT * FROM reactions WHERE livestream_id = ?"
+	args := []any{livestreamID}
+	if cond, condArgs := pageReq.Where("created_at", "id"); cond != "" {
+		query += " AND " + cond
+		args = append(args, condArgs...)
 	}
+	query += pageReq.OrderByAndLimit("created_at", "id")
 
 	reactionModels := []ReactionModel{}
-	if err := tx.SelectContext(ctx, &reactionModels, query, livestreamID); err != nil {
+	if err := tx.SelectContext(ctx, &reactionModels, query, args...); err != nil {
 		return echo.NewHTTPError(http.StatusNotFound, "failed to get reactions")
 	}
 
@@ -82,7 +80,9 @@ func getReactionsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, reactions)
+	return c.JSON(http.StatusOK, newPage(pageReq, reactions, func(r Reaction) pageCursor {
+		return pageCursor{Key: r.CreatedAt, ID: r.ID}
+	}))
 }
 
 func postReactionHandler(c echo.Context) error {
@@ -94,15 +94,7 @@ func postReactionHandler(c echo.Context) error {
 
 	LivecommentCache.Remove(fmt.Sprintf("%d", livestreamID))
 
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
-		return err
-	}
-
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := getAuthUserID(c)
 
 	var req *PostReactionRequest
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
@@ -115,6 +107,18 @@ func postReactionHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
+	// 配信中のみリアクションできる
+	livestreamModel, err := getLivestreamInStatus(ctx, tx, int64(livestreamID), livestreamStatusLive)
+	if err != nil {
+		return err
+	}
+	if err := checkNotBanned(ctx, tx, livestreamModel, userID); err != nil {
+		return err
+	}
+	if _, err := checkRateLimit(c, RateLimitBucket{Key: rateLimitKey("reaction", userID, livestreamModel.ID), Limit: reactionRateLimit}); err != nil {
+		return err
+	}
+
 	reactionModel := ReactionModel{
 		UserID:       int64(userID),
 		LivestreamID: int64(livestreamID),
@@ -142,6 +146,8 @@ func postReactionHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	LivestreamEventHub.Publish(int64(livestreamID), livestreamEventReactionCreated, reaction)
+
 	return c.JSON(http.StatusCreated, reaction)
 }
 
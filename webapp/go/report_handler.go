@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// スパム報告の状態
+const (
+	reportStatusOpen      = "open"
+	reportStatusDismissed = "dismissed"
+	reportStatusActioned  = "actioned"
+)
+
+// スパム報告への対応
+const (
+	// ライブコメントを非表示にする
+	reportActionHide = "hide"
+	// ライブコメントを非表示にし、投稿したユーザをBANする
+	reportActionBan = "ban"
+	// 問題なしとして却下する。報告数で自動的に非表示になっていたら再表示する
+	reportActionDismiss = "dismiss"
+)
+
+// 一度に対応できる報告の数
+const maxResolveReports = 100
+
+// ライブコメントごとの報告の集計
+type LivecommentReportSummary struct {
+	Livecomment    Livecomment `json:"livecomment"`
+	ReportCount    int64       `json:"report_count"`
+	OpenCount      int64       `json:"open_count"`
+	LastReportedAt int64       `json:"last_reported_at"`
+}
+
+type livecommentReportSummaryRow struct {
+	LivecommentID  int64 `db:"livecomment_id"`
+	ReportCount    int64 `db:"report_count"`
+	OpenCount      int64 `db:"open_count"`
+	LastReportedAt int64 `db:"last_reported_at"`
+}
+
+type ResolveLivecommentReportsRequest struct {
+	ReportIDs []int64 `json:"report_ids"`
+	// hide | ban | dismiss
+	Action string `json:"action"`
+}
+
+// ?status= を検証する。未指定なら空文字を返す
+// 返すエラーはecho.NewHTTPErrorなのでそのまま出力してよい
+func parseReportStatusQuery(c echo.Context) (string, error) {
+	status := c.QueryParam("status")
+	switch status {
+	case "", reportStatusOpen, reportStatusDismissed, reportStatusActioned:
+		return status, nil
+	default:
+		return "", echo.NewHTTPError(http.StatusBadRequest, "status query parameter must be open, dismissed or actioned")
+	}
+}
+
+// 直近の報告者数がしきい値に達したライブコメントを、配信者が確認するまで自動で非表示にする
+// 非表示にしたかどうかと、数えた報告者数を返す
+func hideReportedLivecomment(ctx context.Context, tx *sqlx.Tx, livestreamID, livecommentID, now int64) (bool, int64, error) {
+	settings, err := getModerationSettings(ctx, tx, livestreamID)
+	if err != nil {
+		return false, 0, err
+	}
+	if settings.ReportThreshold <= 0 {
+		return false, 0, nil
+	}
+
+	// 却下済みの報告と、他の配信のしきい値で数えるべき報告は数えない
+	var reporters int64
+	if err := tx.GetContext(ctx, &reporters, "SELECT COUNT(DISTINCT user_id) FROM livecomment_reports WHERE livecomment_id = ? AND livestream_id = ? AND status = ? AND created_at > ?", livecommentID, livestreamID, reportStatusOpen, now-settings.ReportWindowSeconds); err != nil {
+		return false, 0, err
+	}
+	if reporters < settings.ReportThreshold {
+		return false, reporters, nil
+	}
+
+	hiddenIDs, err := hideLivecomments(ctx, tx, livestreamID, []int64{livecommentID}, hiddenReasonReportThreshold, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	return len(hiddenIDs) > 0, reporters, nil
+}
+
+// (配信者向け)ライブコメントごとの報告数の集計
+// 報告の多い順に返す
+// GET /api/livestream/:livestream_id/report/summary
+func getLivecommentReportSummaryHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := getAuthUserID(c)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	status, err := parseReportStatusQuery(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	if _, err := getModeratableLivestream(ctx, tx, int64(livestreamID), userID); err != nil {
+		return err
+	}
+
+	query := "SELECT livecomment_id, COUNT(*) AS report_count, CAST(SUM(status = ?) AS SIGNED) AS open_count, MAX(created_at) AS last_reported_at FROM livecomment_reports WHERE livestream_id = ?"
+	args := []any{reportStatusOpen, livestreamID}
+	if status != "" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	query += " GROUP BY livecomment_id ORDER BY report_count DESC, last_reported_at DESC"
+
+	var rows []livecommentReportSummaryRow
+	if err := tx.SelectContext(ctx, &rows, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment report summary: "+err.Error())
+	}
+
+	summaries := make([]LivecommentReportSummary, len(rows))
+	for i := range rows {
+		var livecommentModel LivecommentModel
+		if err := tx.GetContext(ctx, &livecommentModel, "SELECT * FROM livecomments WHERE id = ?", rows[i].LivecommentID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment: "+err.Error())
+		}
+		livecomment, err := fillLivecommentResponse(ctx, tx, livecommentModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment: "+err.Error())
+		}
+		summaries[i] = LivecommentReportSummary{
+			Livecomment:    livecomment,
+			ReportCount:    rows[i].ReportCount,
+			OpenCount:      rows[i].OpenCount,
+			LastReportedAt: rows[i].LastReportedAt,
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, summaries)
+}
+
+// (配信者向け)スパム報告にまとめて対応する
+// 対象のライブコメントに寄せられた未対応の報告は、指定されなかったものもあわせて対応済みにする
+// POST /api/livestream/:livestream_id/report/resolve
+func resolveLivecommentReportsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	userID := getAuthUserID(c)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var req *ResolveLivecommentReportsRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "request body must be a json object")
+	}
+
+	var status string
+	switch req.Action {
+	case reportActionHide, reportActionBan:
+		status = reportStatusActioned
+	case reportActionDismiss:
+		status = reportStatusDismissed
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "action must be hide, ban or dismiss")
+	}
+
+	reportIDs := slices.Clone(req.ReportIDs)
+	slices.Sort(reportIDs)
+	reportIDs = slices.Compact(reportIDs)
+	if len(reportIDs) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "report_ids must not be empty")
+	}
+	if len(reportIDs) > maxResolveReports {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("report_ids must contain at most %d reports", maxResolveReports))
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := getModeratableLivestream(ctx, tx, int64(livestreamID), userID)
+	if err != nil {
+		return err
+	}
+
+	query, args, err := sqlx.In("SELECT * FROM livecomment_reports WHERE livestream_id = ? AND id IN (?) FOR UPDATE", livestreamID, reportIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to build query: "+err.Error())
+	}
+	var reportModels []LivecommentReportModel
+	if err := tx.SelectContext(ctx, &reportModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment reports: "+err.Error())
+	}
+	if len(reportModels) != len(reportIDs) {
+		return echo.NewHTTPError(http.StatusNotFound, "livecomment report not found")
+	}
+
+	var reportedIDs []int64
+	for _, r := range reportModels {
+		if !slices.Contains(reportedIDs, r.LivecommentID) {
+			reportedIDs = append(reportedIDs, r.LivecommentID)
+		}
+	}
+
+	var hiddenIDs []int64
+	if req.Action == reportActionHide || req.Action == reportActionBan {
+		hiddenIDs, err = hideLivecomments(ctx, tx, livestreamModel.ID, reportedIDs, hiddenReasonManual, &userID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to hide livecomments: "+err.Error())
+		}
+	}
+
+	if req.Action == reportActionBan {
+		query, args, err := sqlx.In("SELECT DISTINCT user_id FROM livecomments WHERE id IN (?)", reportedIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to build query: "+err.Error())
+		}
+		var authorIDs []int64
+		if err := tx.SelectContext(ctx, &authorIDs, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment authors: "+err.Error())
+		}
+		for _, authorID := range authorIDs {
+			if authorID == livestreamModel.UserID {
+				return echo.NewHTTPError(http.StatusBadRequest, "can't ban the streamer")
+			}
+			if err := banUser(ctx, tx, &LivestreamBanModel{
+				StreamerID:   livestreamModel.UserID,
+				LivestreamID: &livestreamModel.ID,
+				UserID:       authorID,
+				Reason:       "reported livecomment",
+				CreatedBy:    userID,
+				CreatedAt:    time.Now().Unix(),
+			}); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to ban user: "+err.Error())
+			}
+		}
+	}
+
+	// 報告数で自動的に非表示になっていたものは、却下されたら再表示する
+	var restored []Livecomment
+	if req.Action == reportActionDismiss {
+		query, args, err := sqlx.In("SELECT * FROM livecomments WHERE id IN (?) AND hidden_reason = ? FOR UPDATE", reportedIDs, hiddenReasonReportThreshold)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to build query: "+err.Error())
+		}
+		var restoredModels []LivecommentModel
+		if err := tx.SelectContext(ctx, &restoredModels, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get hidden livecomments: "+err.Error())
+		}
+		restoreIDs := make([]int64, len(restoredModels))
+		for i := range restoredModels {
+			restoreIDs[i] = restoredModels[i].ID
+		}
+		if err := restoreLivecomments(ctx, tx, livestreamModel.ID, restoreIDs, hiddenReasonReportThreshold, &userID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to restore livecomments: "+err.Error())
+		}
+		for i := range restoredModels {
+			livecomment, err := fillLivecommentResponse(ctx, tx, restoredModels[i])
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment: "+err.Error())
+			}
+			restored = append(restored, livecomment)
+		}
+	}
+
+	now := time.Now().Unix()
+	query, args, err = sqlx.In("UPDATE livecomment_reports SET status = ?, resolved_at = ?, resolved_by = ? WHERE livestream_id = ? AND livecomment_id IN (?) AND status = ?", status, now, userID, livestreamID, reportedIDs, reportStatusOpen)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to build query: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livecomment reports: "+err.Error())
+	}
+
+	query, args, err = sqlx.In("SELECT * FROM livecomment_reports WHERE id IN (?) ORDER BY id", reportIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to build query: "+err.Error())
+	}
+	reportModels = nil
+	if err := tx.SelectContext(ctx, &reportModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment reports: "+err.Error())
+	}
+	reports := make([]LivecommentReport, len(reportModels))
+	for i := range reportModels {
+		report, err := fillLivecommentReportResponse(ctx, tx, reportModels[i])
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment report: "+err.Error())
+		}
+		reports[i] = report
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	publishHiddenLivecomments(livestreamModel.ID, hiddenIDs)
+	publishRestoredLivecomments(livestreamModel.ID, restored)
+
+	return c.JSON(http.StatusOK, reports)
+}
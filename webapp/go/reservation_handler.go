@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	reservationTermStartAtEnvKey  = "ISUCON13_RESERVATION_TERM_START_AT"
+	reservationTermEndAtEnvKey    = "ISUCON13_RESERVATION_TERM_END_AT"
+	reservationSlotDurationEnvKey = "ISUCON13_RESERVATION_SLOT_DURATION"
+	reservationSlotCapacityEnvKey = "ISUCON13_RESERVATION_SLOT_CAPACITY"
+
+	// 一度に生成できる予約枠の数
+	maxGeneratedReservationSlots = 24 * 366 * 2
+	// 予約枠をまとめてINSERTする件数
+	reservationSlotInsertBatchSize = 1000
+)
+
+const (
+	// 一度に取得できる予約枠の期間
+	maxReservationSlotsRange = 31 * 24 * time.Hour
+	// 空き枠の提案で指定できる最大の時間数
+	maxSuggestReservationHours = 24
+	// 空き枠を探す範囲
+	suggestReservationHorizon = 31 * 24 * time.Hour
+	// 空き枠を探すときに読む予約枠の上限
+	maxSuggestReservationSlots = 10000
+)
+
+// 環境変数で設定される、初期データの予約枠に対応する予約期間と予約枠の既定値
+// 未設定の場合は 2023/11/25 10:00 JST からの1年間、1時間ごとに5枠
+type reservationConfig struct {
+	TermStartAt  int64
+	TermEndAt    int64
+	SlotDuration time.Duration
+	SlotCapacity int64
+}
+
+var reservationConf = reservationConfig{
+	TermStartAt:  time.Date(2023, 11, 25, 1, 0, 0, 0, time.UTC).Unix(),
+	TermEndAt:    time.Date(2024, 11, 25, 1, 0, 0, 0, time.UTC).Unix(),
+	SlotDuration: 1 * time.Hour,
+	SlotCapacity: 5,
+}
+
+var errReservationSlotUnavailable = errors.New("reservation slot is unavailable")
+
+type ReservationSlotModel struct {
+	ID      int64 `db:"id" json:"id"`
+	Slot    int64 `db:"slot" json:"slot"`
+	StartAt int64 `db:"start_at" json:"start_at"`
+	EndAt   int64 `db:"end_at" json:"end_at"`
+}
+
+// 予約を受け付ける期間
+type ReservationTermModel struct {
+	ID           int64 `db:"id" json:"id"`
+	StartAt      int64 `db:"start_at" json:"start_at"`
+	EndAt        int64 `db:"end_at" json:"end_at"`
+	SlotDuration int64 `db:"slot_duration" json:"slot_duration"`
+	SlotCapacity int64 `db:"slot_capacity" json:"slot_capacity"`
+	CreatedAt    int64 `db:"created_at" json:"created_at"`
+}
+
+type PostReservationTermRequest struct {
+	StartAt int64 `json:"start_at"`
+	EndAt   int64 `json:"end_at"`
+	// 秒単位。省略時は設定値を使う
+	SlotDuration int64 `json:"slot_duration"`
+	// 省略時は設定値を使う
+	SlotCapacity int64 `json:"slot_capacity"`
+}
+
+type ReservationSlot struct {
+	StartAt   int64 `json:"start_at"`
+	EndAt     int64 `json:"end_at"`
+	Remaining int64 `json:"remaining"`
+}
+
+type ReservationWindow struct {
+	StartAt int64             `json:"start_at"`
+	EndAt   int64             `json:"end_at"`
+	Slots   []ReservationSlot `json:"slots"`
+}
+
+// 予約枠の空き状況
+// GET /api/reservation_slots?from=&to=
+func getReservationSlotsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	from, err := strconv.ParseInt(c.QueryParam("from"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "from query parameter must be integer")
+	}
+	to, err := strconv.ParseInt(c.QueryParam("to"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "to query parameter must be integer")
+	}
+	if from >= to {
+		return echo.NewHTTPError(http.StatusBadRequest, "from must be before to")
+	}
+	if time.Duration(to-from)*time.Second > maxReservationSlotsRange {
+		return echo.NewHTTPError(http.StatusBadRequest, "requested range is too long")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var slotModels []*ReservationSlotModel
+	if err := tx.SelectContext(ctx, &slotModels, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? ORDER BY start_at", from, to); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	slots := make([]ReservationSlot, len(slotModels))
+	for i := range slotModels {
+		slots[i] = fillReservationSlotResponse(*slotModels[i])
+	}
+
+	return c.JSON(http.StatusOK, slots)
+}
+
+// 指定した時間数だけ連続で予約できる、最も早い枠を提案する
+// GET /api/reservation_slots/suggest?hours=&from=
+func suggestReservationSlotsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	hours, err := strconv.Atoi(c.QueryParam("hours"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "hours query parameter must be integer")
+	}
+	if hours < 1 || hours > maxSuggestReservationHours {
+		return echo.NewHTTPError(http.StatusBadRequest, "hours query parameter is out of range")
+	}
+
+	from := time.Now().Unix()
+	if v := c.QueryParam("from"); v != "" {
+		from, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "from query parameter must be integer")
+		}
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var slotModels []*ReservationSlotModel
+	to := from + int64(suggestReservationHorizon/time.Second)
+	if err := tx.SelectContext(ctx, &slotModels, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? ORDER BY start_at LIMIT ?", from, to, maxSuggestReservationSlots); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// 空きがあり、かつ途切れずに続いている枠を、合計がhours時間になるまで集める
+	// 枠の長さは予約期間ごとに異なるので、枠の数ではなく時刻で判定する
+	duration := int64(hours) * 3600
+	var window []*ReservationSlotModel
+	for _, slot := range slotModels {
+		if slot.Slot < 1 || (len(window) > 0 && window[len(window)-1].EndAt != slot.StartAt) {
+			window = window[:0]
+		}
+		if slot.Slot < 1 {
+			continue
+		}
+		window = append(window, slot)
+
+		if window[len(window)-1].EndAt-window[0].StartAt >= duration {
+			slots := make([]ReservationSlot, len(window))
+			for i := range window {
+				slots[i] = fillReservationSlotResponse(*window[i])
+			}
+			return c.JSON(http.StatusOK, ReservationWindow{
+				StartAt: window[0].StartAt,
+				EndAt:   window[len(window)-1].EndAt,
+				Slots:   slots,
+			})
+		}
+	}
+
+	return echo.NewHTTPError(http.StatusNotFound, "no available reservation window")
+}
+
+// 予約期間の一覧
+// GET /api/reservation_terms
+func getReservationTermsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	terms, err := getReservationTerms(ctx, tx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_terms: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, terms)
+}
+
+// (管理者向け)予約期間を新しく開き、対応する予約枠を生成する
+// POST /api/admin/reservation_terms
+func postReservationTermHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	var req *PostReservationTermRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "request body must be a json object")
+	}
+
+	term := ReservationTermModel{
+		StartAt:      req.StartAt,
+		EndAt:        req.EndAt,
+		SlotDuration: req.SlotDuration,
+		SlotCapacity: req.SlotCapacity,
+		CreatedAt:    time.Now().Unix(),
+	}
+	if term.SlotDuration == 0 {
+		term.SlotDuration = int64(reservationConf.SlotDuration / time.Second)
+	}
+	if term.SlotCapacity == 0 {
+		term.SlotCapacity = reservationConf.SlotCapacity
+	}
+
+	if term.StartAt >= term.EndAt {
+		return echo.NewHTTPError(http.StatusBadRequest, "start_at must be before end_at")
+	}
+	if term.SlotDuration < 1 || (term.EndAt-term.StartAt)%term.SlotDuration != 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "term must be divisible by slot_duration")
+	}
+	if term.SlotCapacity < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "slot_capacity must be positive")
+	}
+	if (term.EndAt-term.StartAt)/term.SlotDuration > maxGeneratedReservationSlots {
+		return echo.NewHTTPError(http.StatusBadRequest, "term is too long")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	// 既存の予約期間・予約枠と重なっていないか
+	terms, err := getReservationTerms(ctx, tx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_terms: "+err.Error())
+	}
+	for _, t := range terms {
+		if t.StartAt < term.EndAt && term.StartAt < t.EndAt {
+			return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("term overlaps with existing term %d ~ %d", t.StartAt, t.EndAt))
+		}
+	}
+	var overlappedSlots int64
+	if err := tx.GetContext(ctx, &overlappedSlots, "SELECT COUNT(*) FROM reservation_slots WHERE start_at < ? AND end_at > ?", term.EndAt, term.StartAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reservation_slots: "+err.Error())
+	}
+	if overlappedSlots > 0 {
+		return echo.NewHTTPError(http.StatusConflict, "term overlaps with existing reservation slots")
+	}
+
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO reservation_terms (start_at, end_at, slot_duration, slot_capacity, created_at) VALUES (:start_at, :end_at, :slot_duration, :slot_capacity, :created_at)", term)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reservation_term: "+err.Error())
+	}
+	termID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted reservation_term id: "+err.Error())
+	}
+	term.ID = termID
+
+	if err := generateReservationSlots(ctx, tx, term); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reservation_slots: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, term)
+}
+
+func loadReservationConfig() error {
+	if v, ok := os.LookupEnv(reservationTermStartAtEnvKey); ok {
+		startAt, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as unix time: %+v", reservationTermStartAtEnvKey, err)
+		}
+		reservationConf.TermStartAt = startAt
+	}
+	if v, ok := os.LookupEnv(reservationTermEndAtEnvKey); ok {
+		endAt, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as unix time: %+v", reservationTermEndAtEnvKey, err)
+		}
+		reservationConf.TermEndAt = endAt
+	}
+	if v, ok := os.LookupEnv(reservationSlotDurationEnvKey); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as duration: %+v", reservationSlotDurationEnvKey, err)
+		}
+		if d < time.Second {
+			return fmt.Errorf("environment variable '%s' must be at least 1s", reservationSlotDurationEnvKey)
+		}
+		reservationConf.SlotDuration = d
+	}
+	if v, ok := os.LookupEnv(reservationSlotCapacityEnvKey); ok {
+		capacity, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("failed to parse environment variable '%s' as integer: %+v", reservationSlotCapacityEnvKey, err)
+		}
+		if capacity < 1 {
+			return fmt.Errorf("environment variable '%s' must be positive", reservationSlotCapacityEnvKey)
+		}
+		reservationConf.SlotCapacity = capacity
+	}
+	if reservationConf.TermStartAt >= reservationConf.TermEndAt {
+		return fmt.Errorf("reservation term start must be before its end")
+	}
+	return nil
+}
+
+// 予約期間の予約枠を生成する
+// 既存の予約枠と重なる区間は生成しないので、初期データの予約枠を補うのにも使える
+func generateReservationSlots(ctx context.Context, tx *sqlx.Tx, term ReservationTermModel) error {
+	var existing []*ReservationSlotModel
+	if err := tx.SelectContext(ctx, &existing, "SELECT * FROM reservation_slots WHERE start_at < ? AND end_at > ? ORDER BY start_at", term.EndAt, term.StartAt); err != nil {
+		return err
+	}
+
+	slots := make([]ReservationSlotModel, 0, reservationSlotInsertBatchSize)
+	flush := func() error {
+		if len(slots) == 0 {
+			return nil
+		}
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO reservation_slots (slot, start_at, end_at) VALUES (:slot, :start_at, :end_at)", slots); err != nil {
+			return err
+		}
+		slots = slots[:0]
+		return nil
+	}
+
+	i := 0
+	for startAt := term.StartAt; startAt < term.EndAt; startAt += term.SlotDuration {
+		endAt := startAt + term.SlotDuration
+		// existingはstart_at順なので、この枠より前に終わるものは以降も重ならない
+		for i < len(existing) && existing[i].EndAt <= startAt {
+			i++
+		}
+		if i < len(existing) && existing[i].StartAt < endAt {
+			continue
+		}
+		slots = append(slots, ReservationSlotModel{
+			Slot:    term.SlotCapacity,
+			StartAt: startAt,
+			EndAt:   endAt,
+		})
+		if len(slots) == reservationSlotInsertBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+// 環境変数で設定された予約期間をreservation_termsに登録し、予約枠の欠けている区間を生成する
+// 起動時と初期化時に呼ぶ
+func ensureConfiguredReservationTerm(ctx context.Context) error {
+	term := ReservationTermModel{
+		StartAt:      reservationConf.TermStartAt,
+		EndAt:        reservationConf.TermEndAt,
+		SlotDuration: int64(reservationConf.SlotDuration / time.Second),
+		SlotCapacity: reservationConf.SlotCapacity,
+		CreatedAt:    time.Now().Unix(),
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	terms, err := getReservationTerms(ctx, tx)
+	if err != nil {
+		return err
+	}
+	registered := false
+	for _, t := range terms {
+		if t.StartAt == term.StartAt && t.EndAt == term.EndAt {
+			term = t
+			registered = true
+			break
+		}
+		if t.StartAt < term.EndAt && term.StartAt < t.EndAt {
+			return fmt.Errorf("configured reservation term overlaps with existing term %d ~ %d", t.StartAt, t.EndAt)
+		}
+	}
+
+	if !registered {
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO reservation_terms (start_at, end_at, slot_duration, slot_capacity, created_at) VALUES (:start_at, :end_at, :slot_duration, :slot_capacity, :created_at)", term)
+		if err != nil {
+			return err
+		}
+		termID, err := rs.LastInsertId()
+		if err != nil {
+			return err
+		}
+		term.ID = termID
+	}
+
+	if err := generateReservationSlots(ctx, tx, term); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// 予約期間を開始日時の順に返す
+func getReservationTerms(ctx context.Context, tx *sqlx.Tx) ([]ReservationTermModel, error) {
+	terms := []ReservationTermModel{}
+	if err := tx.SelectContext(ctx, &terms, "SELECT * FROM reservation_terms ORDER BY start_at"); err != nil {
+		return nil, err
+	}
+	return terms, nil
+}
+
+// 予約区間を含む予約期間を探す
+func findReservationTerm(ctx context.Context, tx *sqlx.Tx, startAt, endAt int64) (ReservationTermModel, bool, error) {
+	terms, err := getReservationTerms(ctx, tx)
+	if err != nil {
+		return ReservationTermModel{}, false, err
+	}
+	for _, term := range terms {
+		if term.StartAt <= startAt && endAt <= term.EndAt {
+			return term, true, nil
+		}
+	}
+	return ReservationTermModel{}, false, nil
+}
+
+// 予約区間に含まれる予約枠を1つずつ確保する
+// 予約枠が存在しないか、空きのない枠が含まれていればerrReservationSlotUnavailableを返す
+func acquireReservationSlots(ctx context.Context, tx *sqlx.Tx, startAt, endAt int64) error {
+	// NOTE: 並列な予約のoverbooking防止にFOR UPDATEが必要
+	var slots []*ReservationSlotModel
+	if err := tx.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? FOR UPDATE", startAt, endAt); err != nil {
+		return err
+	}
+	if len(slots) == 0 {
+		return errReservationSlotUnavailable
+	}
+	for _, slot := range slots {
+		if slot.Slot < 1 {
+			return errReservationSlotUnavailable
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ?", startAt, endAt); err != nil {
+		return err
+	}
+	return nil
+}
+
+// 予約区間に含まれる予約枠を返却する
+func releaseReservationSlots(ctx context.Context, tx *sqlx.Tx, startAt, endAt int64) error {
+	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot + 1 WHERE start_at >= ? AND end_at <= ?", startAt, endAt); err != nil {
+		return err
+	}
+	return nil
+}
+
+func fillReservationSlotResponse(slotModel ReservationSlotModel) ReservationSlot {
+	return ReservationSlot{
+		StartAt:   slotModel.StartAt,
+		EndAt:     slotModel.EndAt,
+		Remaining: slotModel.Slot,
+	}
+}
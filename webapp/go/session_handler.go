@@ -0,0 +1,217 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// 最後のアクセスからこの期間が過ぎるとセッションは失効する
+	sessionLifetime = 1 * time.Hour
+	// 有効期限の延長は、この間隔より頻繁には書き込まない
+	sessionTouchInterval = 1 * time.Minute
+)
+
+type Session struct {
+	ID         int64  `json:"id"`
+	UserAgent  string `json:"user_agent"`
+	IPAddress  string `json:"ip_address"`
+	CreatedAt  int64  `json:"created_at"`
+	LastSeenAt int64  `json:"last_seen_at"`
+	ExpiresAt  int64  `json:"expires_at"`
+	// リクエストしたセッション自身かどうか
+	Current bool `json:"current"`
+}
+
+// サーバ側にセッションを作成し、SESSIONIDなどをCookieに保存する
+// 返すエラーはecho.NewHTTPErrorなのでそのまま出力してよい
+func startSession(c echo.Context, userModel UserModel) error {
+	ctx := c.Request().Context()
+
+	now := time.Now()
+	sessionEndAt := now.Add(sessionLifetime)
+
+	sessionID := uuid.NewString()
+
+	if err := sessionStore.Create(ctx, &SessionModel{
+		UserID:     userModel.ID,
+		TokenHash:  hashSessionToken(sessionID),
+		UserAgent:  c.Request().UserAgent(),
+		IPAddress:  c.RealIP(),
+		CreatedAt:  now.Unix(),
+		LastSeenAt: now.Unix(),
+		ExpiresAt:  sessionEndAt.Unix(),
+	}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to create session: "+err.Error())
+	}
+
+	sess, err := session.Get(defaultSessionIDKey, c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get session")
+	}
+
+	sess.Options = &sessions.Options{
+		Domain: "t.isucon.pw",
+		MaxAge: int(60000),
+		Path:   "/",
+	}
+	sess.Values[defaultSessionIDKey] = sessionID
+	sess.Values[defaultUserIDKey] = userModel.ID
+	sess.Values[defaultUsernameKey] = userModel.Name
+	sess.Values[defaultSessionExpiresKey] = sessionEndAt.Unix()
+
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error())
+	}
+
+	return nil
+}
+
+// CookieのSESSIONIDに対応するサーバ側のセッションを確認し、有効期限を延長する
+// 返すエラーはecho.NewHTTPErrorなのでそのまま出力してよい
+func verifyServerSession(c echo.Context, sessionID string, userID int64, username string) error {
+	ctx := c.Request().Context()
+	now := time.Now()
+
+	sessionModel, err := sessionStore.GetByTokenHash(ctx, hashSessionToken(sessionID), now.Unix())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get session: "+err.Error())
+	}
+	if sessionModel == nil || sessionModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusUnauthorized, "session has expired or been revoked")
+	}
+
+	if now.Unix()-sessionModel.LastSeenAt >= int64(sessionTouchInterval/time.Second) {
+		if err := sessionStore.Touch(ctx, sessionModel.ID, now.Unix(), now.Add(sessionLifetime).Unix()); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update session: "+err.Error())
+		}
+	}
+
+	c.Set(authContextKey, &authContext{
+		UserID:    userID,
+		Username:  username,
+		SessionID: sessionModel.ID,
+	})
+	return nil
+}
+
+// Cookieのセッションを破棄する
+// 返すエラーはecho.NewHTTPErrorなのでそのまま出力してよい
+func clearSessionCookie(c echo.Context) error {
+	sess, err := session.Get(defaultSessionIDKey, c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get session")
+	}
+	sess.Options = &sessions.Options{
+		Domain: "t.isucon.pw",
+		MaxAge: -1,
+		Path:   "/",
+	}
+	sess.Values = map[any]any{}
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error())
+	}
+	return nil
+}
+
+// ログアウト
+// POST /api/logout
+func logoutHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := getAuthUserID(c)
+	currentID := getAuth(c).SessionID
+
+	if _, err := sessionStore.Delete(ctx, userID, currentID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete session: "+err.Error())
+	}
+
+	if err := clearSessionCookie(c); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// すべての端末からログアウト
+// POST /api/logout/all
+func logoutAllHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := getAuthUserID(c)
+
+	if err := sessionStore.DeleteAllByUser(ctx, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete sessions: "+err.Error())
+	}
+
+	if err := clearSessionCookie(c); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// ログイン中のセッション一覧
+// GET /api/user/me/sessions
+func getSessionsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := getAuthUserID(c)
+	currentID := getAuth(c).SessionID
+
+	sessionModels, err := sessionStore.ListByUser(ctx, userID, time.Now().Unix())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get sessions: "+err.Error())
+	}
+
+	sessions := make([]Session, len(sessionModels))
+	for i := range sessionModels {
+		sessions[i] = Session{
+			ID:         sessionModels[i].ID,
+			UserAgent:  sessionModels[i].UserAgent,
+			IPAddress:  sessionModels[i].IPAddress,
+			CreatedAt:  sessionModels[i].CreatedAt,
+			LastSeenAt: sessionModels[i].LastSeenAt,
+			ExpiresAt:  sessionModels[i].ExpiresAt,
+			Current:    sessionModels[i].ID == currentID,
+		}
+	}
+
+	return c.JSON(http.StatusOK, sessions)
+}
+
+// セッションの失効
+// DELETE /api/user/me/sessions/:session_id
+func deleteSessionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID := getAuthUserID(c)
+	currentID := getAuth(c).SessionID
+
+	sessionID, err := strconv.ParseInt(c.Param("session_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "session_id in path must be integer")
+	}
+
+	deleted, err := sessionStore.Delete(ctx, userID, sessionID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete session: "+err.Error())
+	}
+	if !deleted {
+		return echo.NewHTTPError(http.StatusNotFound, "session not found")
+	}
+
+	if sessionID == currentID {
+		if err := clearSessionCookie(c); err != nil {
+			return err
+		}
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+)
+
+// セッションの保存先。mysql (既定) または memory
+const sessionStoreEnvKey = "ISUCON13_SESSION_STORE"
+
+type SessionModel struct {
+	ID     int64 `db:"id"`
+	UserID int64 `db:"user_id"`
+	// CookieのSESSIONIDのハッシュ。SESSIONIDそのものはサーバに残さない
+	TokenHash  string `db:"token_hash"`
+	UserAgent  string `db:"user_agent"`
+	IPAddress  string `db:"ip_address"`
+	CreatedAt  int64  `db:"created_at"`
+	LastSeenAt int64  `db:"last_seen_at"`
+	ExpiresAt  int64  `db:"expires_at"`
+}
+
+// サーバ側でセッションを管理するストア
+// ログアウトやセッションの失効をCookieの有効期限に依存せずに行うために使う
+type SessionStore interface {
+	// セッションを保存し、IDを設定する
+	Create(ctx context.Context, s *SessionModel) error
+	// 有効期限内のセッションを返す。なければnil
+	GetByTokenHash(ctx context.Context, tokenHash string, now int64) (*SessionModel, error)
+	// 最終アクセス時刻と有効期限を更新する
+	Touch(ctx context.Context, id, lastSeenAt, expiresAt int64) error
+	// ユーザのセッションを1つ削除する。削除したかどうかを返す
+	Delete(ctx context.Context, userID, id int64) (bool, error)
+	// ユーザのすべてのセッションを削除する
+	DeleteAllByUser(ctx context.Context, userID int64) error
+	// ユーザの有効期限内のセッションを新しい順に返す
+	ListByUser(ctx context.Context, userID int64, now int64) ([]SessionModel, error)
+	// すべてのセッションを破棄する
+	Reset(ctx context.Context) error
+}
+
+var sessionStore SessionStore = &mysqlSessionStore{}
+
+func loadSessionStoreConfig() error {
+	switch v := os.Getenv(sessionStoreEnvKey); v {
+	case "", "mysql":
+		sessionStore = &mysqlSessionStore{}
+	case "memory":
+		sessionStore = newMemorySessionStore()
+	default:
+		return fmt.Errorf("environment variable '%s' must be mysql or memory: %s", sessionStoreEnvKey, v)
+	}
+	return nil
+}
+
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type mysqlSessionStore struct{}
+
+func (s *mysqlSessionStore) Create(ctx context.Context, session *SessionModel) error {
+	// 期限切れのセッションはここで掃除する
+	if _, err := dbConn.ExecContext(ctx, "DELETE FROM sessions WHERE user_id = ? AND expires_at <= ?", session.UserID, session.CreatedAt); err != nil {
+		return err
+	}
+	rs, err := dbConn.NamedExecContext(ctx, "INSERT INTO sessions (user_id, token_hash, user_agent, ip_address, created_at, last_seen_at, expires_at) VALUES (:user_id, :token_hash, :user_agent, :ip_address, :created_at, :last_seen_at, :expires_at)", session)
+	if err != nil {
+		return err
+	}
+	id, err := rs.LastInsertId()
+	if err != nil {
+		return err
+	}
+	session.ID = id
+	return nil
+}
+
+func (s *mysqlSessionStore) GetByTokenHash(ctx context.Context, tokenHash string, now int64) (*SessionModel, error) {
+	var session SessionModel
+	if err := dbConn.GetContext(ctx, &session, "SELECT * FROM sessions WHERE token_hash = ? AND expires_at > ?", tokenHash, now); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *mysqlSessionStore) Touch(ctx context.Context, id, lastSeenAt, expiresAt int64) error {
+	_, err := dbConn.ExecContext(ctx, "UPDATE sessions SET last_seen_at = ?, expires_at = ? WHERE id = ?", lastSeenAt, expiresAt, id)
+	return err
+}
+
+func (s *mysqlSessionStore) Delete(ctx context.Context, userID, id int64) (bool, error) {
+	rs, err := dbConn.ExecContext(ctx, "DELETE FROM sessions WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := rs.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (s *mysqlSessionStore) DeleteAllByUser(ctx context.Context, userID int64) error {
+	_, err := dbConn.ExecContext(ctx, "DELETE FROM sessions WHERE user_id = ?", userID)
+	return err
+}
+
+func (s *mysqlSessionStore) ListByUser(ctx context.Context, userID int64, now int64) ([]SessionModel, error) {
+	sessions := []SessionModel{}
+	if err := dbConn.SelectContext(ctx, &sessions, "SELECT * FROM sessions WHERE user_id = ? AND expires_at > ? ORDER BY id DESC", userID, now); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// sessionsテーブルはinit.sqlで初期化される
+func (s *mysqlSessionStore) Reset(ctx context.Context) error {
+	return nil
+}
+
+// プロセス内で完結するストア。再起動するとすべてのセッションが失われる
+type memorySessionStore struct {
+	mu       sync.Mutex
+	nextID   int64
+	sessions map[int64]*SessionModel
+	byToken  map[string]int64
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{
+		sessions: map[int64]*SessionModel{},
+		byToken:  map[string]int64{},
+	}
+}
+
+func (s *memorySessionStore) Create(ctx context.Context, session *SessionModel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, other := range s.sessions {
+		if other.UserID == session.UserID && other.ExpiresAt <= session.CreatedAt {
+			s.deleteLocked(id)
+		}
+	}
+
+	s.nextID++
+	session.ID = s.nextID
+	stored := *session
+	s.sessions[stored.ID] = &stored
+	s.byToken[stored.TokenHash] = stored.ID
+	return nil
+}
+
+func (s *memorySessionStore) GetByTokenHash(ctx context.Context, tokenHash string, now int64) (*SessionModel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.byToken[tokenHash]
+	if !ok {
+		return nil, nil
+	}
+	session := *s.sessions[id]
+	if session.ExpiresAt <= now {
+		return nil, nil
+	}
+	return &session, nil
+}
+
+func (s *memorySessionStore) Touch(ctx context.Context, id, lastSeenAt, expiresAt int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if session, ok := s.sessions[id]; ok {
+		session.LastSeenAt = lastSeenAt
+		session.ExpiresAt = expiresAt
+	}
+	return nil
+}
+
+func (s *memorySessionStore) Delete(ctx context.Context, userID, id int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok || session.UserID != userID {
+		return false, nil
+	}
+	s.deleteLocked(id)
+	return true, nil
+}
+
+func (s *memorySessionStore) DeleteAllByUser(ctx context.Context, userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, session := range s.sessions {
+		if session.UserID == userID {
+			s.deleteLocked(id)
+		}
+	}
+	return nil
+}
+
+func (s *memorySessionStore) ListByUser(ctx context.Context, userID int64, now int64) ([]SessionModel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessions := []SessionModel{}
+	for _, session := range s.sessions {
+		if session.UserID == userID && session.ExpiresAt > now {
+			sessions = append(sessions, *session)
+		}
+	}
+	slices.SortFunc(sessions, func(a, b SessionModel) int {
+		return int(b.ID - a.ID)
+	})
+	return sessions, nil
+}
+
+func (s *memorySessionStore) Reset(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions = map[int64]*SessionModel{}
+	s.byToken = map[string]int64{}
+	return nil
+}
+
+func (s *memorySessionStore) deleteLocked(id int64) {
+	if session, ok := s.sessions[id]; ok {
+		delete(s.byToken, session.TokenHash)
+		delete(s.sessions, id)
+	}
+}
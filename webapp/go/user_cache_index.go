@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// キャッシュのエントリに埋め込まれているユーザから、エントリのキーを引くための索引
+// プロフィールの変更で、キャッシュ全体ではなくそのユーザを含むエントリだけを破棄するのに使う
+type userCacheIndex struct {
+	mu    sync.Mutex
+	keys  map[int64]map[string]struct{}
+	users map[string][]int64
+}
+
+var (
+	// SearchLivestreamCacheの索引。配信者とコラボレーターを引く
+	searchLivestreamCacheUsers = newUserCacheIndex()
+	// LivecommentCacheの索引。コメントの投稿者と、配信の配信者・コラボレーターを引く
+	livecommentCacheUsers = newUserCacheIndex()
+)
+
+func newUserCacheIndex() *userCacheIndex {
+	return &userCacheIndex{
+		keys:  map[int64]map[string]struct{}{},
+		users: map[string][]int64{},
+	}
+}
+
+// 索引を付けたキャッシュを作る。キャッシュから溢れたエントリは索引からも外す
+func newIndexedCache(size int, index *userCacheIndex) (*lru.Cache[string, any], error) {
+	index.Reset()
+	return lru.NewWithEvict[string, any](size, func(key string, _ any) {
+		index.Forget(key)
+	})
+}
+
+// エントリkeyに含まれるユーザを記録する。キャッシュに追加する前に呼ぶ
+func (x *userCacheIndex) Add(key string, userIDs []int64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.forget(key)
+	x.users[key] = userIDs
+	for _, userID := range userIDs {
+		if x.keys[userID] == nil {
+			x.keys[userID] = map[string]struct{}{}
+		}
+		x.keys[userID][key] = struct{}{}
+	}
+}
+
+// ユーザを含むエントリのキー
+// 返したキーをキャッシュから削除すると、追い出し時のコールバックで索引からも外れる
+func (x *userCacheIndex) Keys(userID int64) []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	keys := make([]string, 0, len(x.keys[userID]))
+	for key := range x.keys[userID] {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (x *userCacheIndex) Forget(key string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.forget(key)
+}
+
+func (x *userCacheIndex) forget(key string) {
+	for _, userID := range x.users[key] {
+		delete(x.keys[userID], key)
+		if len(x.keys[userID]) == 0 {
+			delete(x.keys, userID)
+		}
+	}
+	delete(x.users, key)
+}
+
+func (x *userCacheIndex) Reset() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.keys = map[int64]map[string]struct{}{}
+	x.users = map[string][]int64{}
+}
+
+// 配信の配信者とコラボレーター
+func livestreamUserIDs(livestream Livestream) []int64 {
+	userIDs := make([]int64, 0, 1+len(livestream.Collaborators))
+	userIDs = append(userIDs, livestream.Owner.ID)
+	for _, collaborator := range livestream.Collaborators {
+		userIDs = append(userIDs, collaborator.ID)
+	}
+	return userIDs
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"slices"
+	"sort"
+	"testing"
+)
+
+func TestUserCacheIndex(t *testing.T) {
+	index := newUserCacheIndex()
+	cache, err := newIndexedCache(2, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	add := func(key string, userIDs ...int64) {
+		index.Add(key, userIDs)
+		cache.Add(key, struct{}{})
+	}
+	keys := func(userID int64) []string {
+		keys := index.Keys(userID)
+		sort.Strings(keys)
+		return keys
+	}
+
+	add("a", 1, 2)
+	add("b", 2, 3)
+	if got := keys(2); !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("Keys(2) = %v, want [a b]", got)
+	}
+
+	// 同じキーを追加し直したら、以前のユーザは外れる
+	add("b", 3)
+	if got := keys(2); !slices.Equal(got, []string{"a"}) {
+		t.Errorf("after re-adding b, Keys(2) = %v, want [a]", got)
+	}
+
+	// キャッシュから溢れたエントリは索引からも外れる
+	add("c", 1)
+	if got := keys(1); !slices.Equal(got, []string{"c"}) {
+		t.Errorf("after evicting a, Keys(1) = %v, want [c]", got)
+	}
+
+	// 削除したエントリも索引から外れる
+	for _, key := range index.Keys(3) {
+		cache.Remove(key)
+	}
+	if got := keys(3); len(got) != 0 {
+		t.Errorf("after removing, Keys(3) = %v, want none", got)
+	}
+	if got := keys(1); !slices.Equal(got, []string{"c"}) {
+		t.Errorf("after removing b, Keys(1) = %v, want [c]", got)
+	}
+}
@@ -10,10 +10,7 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
-	"time"
 
-	"github.com/google/uuid"
-	"github.com/gorilla/sessions"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
@@ -25,7 +22,8 @@ const (
 	defaultSessionExpiresKey = "EXPIRES"
 	defaultUserIDKey         = "USERID"
 	defaultUsernameKey       = "USERNAME"
-	bcryptDefaultCost        = bcrypt.MinCost
+	// ベンチマークなどで軽くしたい場合は、環境変数 ISUCON13_BCRYPT_COST で下げる
+	bcryptDefaultCost = bcrypt.DefaultCost
 )
 
 var fallbackImage = "../img/NoImage.jpg"
@@ -77,6 +75,11 @@ type LoginRequest struct {
 	Password string `json:"password"`
 }
 
+type PutPasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
 type PostIconRequest struct {
 	Image []byte `json:"image"`
 }
@@ -114,15 +117,7 @@ func getIconHandler(c echo.Context) error {
 func postIconHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
-		return err
-	}
-
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := getAuthUserID(c)
 
 	var req *PostIconRequest
 	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
@@ -151,10 +146,18 @@ func postIconHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted icon id: "+err.Error())
 	}
 
+	refs, err := getUserCacheRefs(ctx, tx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams to refresh: "+err.Error())
+	}
+
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	// icon_hashを含むキャッシュを破棄する
+	refs.Invalidate()
+
 	return c.JSON(http.StatusCreated, &PostIconResponse{
 		ID: iconID,
 	})
@@ -163,15 +166,7 @@ func postIconHandler(c echo.Context) error {
 func getMeHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
-		return err
-	}
-
-	// error already checked
-	sess, _ := session.Get(defaultSessionIDKey, c)
-	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := getAuthUserID(c)
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
@@ -215,7 +210,11 @@ func registerHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "the username 'pipe' is reserved")
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcryptDefaultCost)
+	if err := validatePassword("password", req.Password); err != nil {
+		return err
+	}
+
+	hashedPassword, err := hashPassword(req.Password)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate hashed password: "+err.Error())
 	}
@@ -230,7 +229,7 @@ func registerHandler(c echo.Context) error {
 		Name:           req.Name,
 		DisplayName:    req.DisplayName,
 		Description:    req.Description,
-		HashedPassword: string(hashedPassword),
+		HashedPassword: hashedPassword,
 	}
 
 	result, err := tx.NamedExecContext(ctx, "INSERT INTO users (name, display_name, description, password) VALUES(:name, :display_name, :description, :password)", userModel)
@@ -280,6 +279,12 @@ func loginHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
+	// 照合の前に試行を数えておき、同時に送られた試行でもロックを超えて照合されないようにする
+	attempts, err := beginLoginAttempt(c, req.Username)
+	if err != nil {
+		return err
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
@@ -289,60 +294,133 @@ func loginHandler(c echo.Context) error {
 	userModel := UserModel{}
 	// usernameはUNIQUEなので、whereで一意に特定できる
 	err = tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE name = ?", req.Username)
-	if errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
-	}
-	if err != nil {
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 	}
+	userExists := err == nil
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(userModel.HashedPassword), []byte(req.Password))
-	if err == bcrypt.ErrMismatchedHashAndPassword {
-		return echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
+	// ユーザが存在しなくても照合を行い、応答時間からユーザ名の存在を推測されないようにする
+	hashedPassword := userModel.HashedPassword
+	if !userExists {
+		hashedPassword, err = dummyPasswordHash()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate hashed password: "+err.Error())
+		}
 	}
+
+	ok, err := comparePassword(hashedPassword, req.Password)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to compare hash and password: "+err.Error())
 	}
+	// 設定より弱いハッシュはすぐに照合が終わるので、存在しないユーザと同じく設定された強度での照合も行う
+	// 照合に失敗したユーザのハッシュはハッシュし直されないため、どちらの向きにも時間の差を残さない
+	if userExists && passwordNeedsRehash(hashedPassword) {
+		dummyHash, err := dummyPasswordHash()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate hashed password: "+err.Error())
+		}
+		if _, err := comparePassword(dummyHash, req.Password); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to compare hash and password: "+err.Error())
+		}
+	}
+	if !userExists || !ok {
+		if err := attempts.Fail(ctx); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to record audit event: "+err.Error())
+		}
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
+	}
+	attempts.Succeed()
 
-	sessionEndAt := time.Now().Add(1 * time.Hour)
+	// 設定より弱いハッシュは、平文のパスワードが手元にあるログイン時にハッシュし直す
+	if passwordNeedsRehash(userModel.HashedPassword) {
+		hashedPassword, err := hashPassword(req.Password)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate hashed password: "+err.Error())
+		}
+		// 同時にパスワードが変更されていれば上書きしない
+		if _, err := dbConn.ExecContext(ctx, "UPDATE users SET password = ? WHERE id = ? AND password = ?", hashedPassword, userModel.ID, userModel.HashedPassword); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update hashed password: "+err.Error())
+		}
+	}
 
-	sessionID := uuid.NewString()
+	if err := startSession(c, userModel); err != nil {
+		return err
+	}
 
-	sess, err := session.Get(defaultSessionIDKey, c)
+	return c.NoContent(http.StatusOK)
+}
+
+// パスワード変更API
+// 他の端末のセッションとAPIトークンはすべて失効させ、このリクエストには新しいセッションを発行する
+// PUT /api/user/me/password
+func putPasswordHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	userID := getAuthUserID(c)
+
+	req := PutPasswordRequest{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	if err := validatePassword("new_password", req.NewPassword); err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get session")
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
+	defer tx.Rollback()
 
-	sess.Options = &sessions.Options{
-		Domain: "t.isucon.pw",
-		MaxAge: int(60000),
-		Path:   "/",
+	userModel := UserModel{}
+	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ? FOR UPDATE", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 	}
-	sess.Values[defaultSessionIDKey] = sessionID
-	sess.Values[defaultUserIDKey] = userModel.ID
-	sess.Values[defaultUsernameKey] = userModel.Name
-	sess.Values[defaultSessionExpiresKey] = sessionEndAt.Unix()
 
-	if err := sess.Save(c.Request(), c.Response()); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error())
+	ok, err := comparePassword(userModel.HashedPassword, req.CurrentPassword)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to compare hash and password: "+err.Error())
+	}
+	if !ok {
+		return echo.NewHTTPError(http.StatusForbidden, "current password is incorrect")
 	}
 
-	return c.NoContent(http.StatusOK)
+	hashedPassword, err := hashPassword(req.NewPassword)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate hashed password: "+err.Error())
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE users SET password = ? WHERE id = ?", hashedPassword, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update password: "+err.Error())
+	}
+	// 漏れたパスワードで発行されたトークンも使えないようにする
+	if _, err := tx.ExecContext(ctx, "DELETE FROM api_tokens WHERE user_id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete api tokens: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	if err := sessionStore.DeleteAllByUser(ctx, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete sessions: "+err.Error())
+	}
+	if err := startSession(c, userModel); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
 }
 
 // ユーザ詳細API
 // GET /api/user/:username
 func getUserHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	if err := verifyUserSession(c); err != nil {
-		// echo.NewHTTPErrorが返っているのでそのまま出力
-		return err
-	}
-
 	username := c.Param("username")
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
@@ -377,24 +455,27 @@ func verifyUserSession(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get session")
 	}
 
-	sessionExpires, ok := sess.Values[defaultSessionExpiresKey]
+	_, ok := sess.Values[defaultSessionExpiresKey]
 	if !ok {
 		return echo.NewHTTPError(http.StatusForbidden, "failed to get EXPIRES value from session")
 	}
 
-	_, ok = sess.Values[defaultUserIDKey].(int64)
+	userID, ok := sess.Values[defaultUserIDKey].(int64)
 	if !ok {
 		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get USERID value from session")
 	}
 
-	now := time.Now()
-	if now.Unix() > sessionExpires.(int64) {
-		return echo.NewHTTPError(http.StatusUnauthorized, "session has expired")
+	username, _ := sess.Values[defaultUsernameKey].(string)
+
+	sessionID, ok := sess.Values[defaultSessionIDKey].(string)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get SESSIONID value from session")
 	}
 
-	return nil
+	// 有効期限はサーバ側のセッションで管理し、アクセスのたびに延長する
+	// ログアウトや失効したセッションはここで弾かれる
+	return verifyServerSession(c, sessionID, userID, username)
 }
-
 func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (User, error) {
 	themeModel := ThemeModel{}
 	if err := tx.GetContext(ctx, &themeModel, "SELECT * FROM themes WHERE user_id = ?", userModel.ID); err != nil {
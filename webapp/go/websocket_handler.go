@@ -0,0 +1,130 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// 1メッセージの書き込みにかけてよい時間
+	websocketWriteWait = 10 * time.Second
+	// pongを待つ時間。これを過ぎたら切断されたとみなす
+	websocketPongWait = 60 * time.Second
+	// pingの送信間隔。pongWaitより短くする必要がある
+	websocketPingPeriod = (websocketPongWait * 9) / 10
+	// クライアントからのメッセージは使わないので小さく制限しておく
+	websocketMaxMessageSize = 512
+)
+
+var websocketUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// ライブ配信のイベント(コメント、リアクション、視聴者数)をまとめて受け取るWebSocket
+// GET /api/livestream/:livestream_id/ws
+func livestreamWebSocketHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		} else {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+	}
+
+	viewersCount, err := countLivestreamViewers(ctx, tx, int64(livestreamID))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestream viewers: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	conn, err := websocketUpgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		// Upgraderがエラーレスポンスを書き込み済み
+		c.Logger().Warnf("failed to upgrade websocket: %+v", err)
+		return nil
+	}
+	defer conn.Close()
+
+	sub := LivestreamEventHub.Subscribe(int64(livestreamID))
+	defer LivestreamEventHub.Unsubscribe(int64(livestreamID), sub)
+
+	// 読み込みはpongの受信と切断検知のためだけに行う
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn.SetReadLimit(websocketMaxMessageSize)
+		conn.SetReadDeadline(time.Now().Add(websocketPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(websocketPongWait))
+		})
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// 接続直後の視聴者数を送っておく
+	if err := writeLivestreamEvent(conn, LivestreamEvent{
+		Type: livestreamEventViewersChanged,
+		Data: ViewersChangedEvent{ViewersCount: viewersCount},
+	}); err != nil {
+		return nil
+	}
+
+	ping := time.NewTicker(websocketPingPeriod)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-done:
+			return nil
+		case event, ok := <-sub.C:
+			if !ok {
+				// 送信が詰まって購読を解除された
+				conn.SetWriteDeadline(time.Now().Add(websocketWriteWait))
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "send buffer overflow"))
+				return nil
+			}
+			if err := writeLivestreamEvent(conn, event); err != nil {
+				return nil
+			}
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(websocketWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+func writeLivestreamEvent(conn *websocket.Conn, event LivestreamEvent) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(websocketWriteWait)); err != nil {
+		return err
+	}
+	return conn.WriteJSON(event)
+}
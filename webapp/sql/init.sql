@@ -1,25 +1,44 @@
 TRUNCATE TABLE themes;
 TRUNCATE TABLE icons;
 TRUNCATE TABLE reservation_slots;
+TRUNCATE TABLE reservation_terms;
 TRUNCATE TABLE livestream_viewers_history;
 TRUNCATE TABLE livecomment_reports;
+TRUNCATE TABLE livestream_bans;
+TRUNCATE TABLE livestream_moderation_settings;
 TRUNCATE TABLE ng_words;
+TRUNCATE TABLE ng_word_lists;
 TRUNCATE TABLE reactions;
 TRUNCATE TABLE tags;
 TRUNCATE TABLE livestream_tags;
 TRUNCATE TABLE livecomments;
+TRUNCATE TABLE moderation_logs;
 TRUNCATE TABLE livestreams;
+TRUNCATE TABLE livestream_series;
+TRUNCATE TABLE livestream_collaborators;
 TRUNCATE TABLE users;
+TRUNCATE TABLE sessions;
+TRUNCATE TABLE api_tokens;
+TRUNCATE TABLE audit_events;
 
 ALTER TABLE `themes` auto_increment = 1;
 ALTER TABLE `icons` auto_increment = 1;
 ALTER TABLE `reservation_slots` auto_increment = 1;
+ALTER TABLE `reservation_terms` auto_increment = 1;
 ALTER TABLE `livestream_tags` auto_increment = 1;
 ALTER TABLE `livestream_viewers_history` auto_increment = 1;
 ALTER TABLE `livecomment_reports` auto_increment = 1;
+ALTER TABLE `livestream_bans` auto_increment = 1;
 ALTER TABLE `ng_words` auto_increment = 1;
+ALTER TABLE `ng_word_lists` auto_increment = 1;
 ALTER TABLE `reactions` auto_increment = 1;
 ALTER TABLE `tags` auto_increment = 1;
 ALTER TABLE `livecomments` auto_increment = 1;
+ALTER TABLE `moderation_logs` auto_increment = 1;
 ALTER TABLE `livestreams` auto_increment = 1;
-ALTER TABLE `users` auto_increment = 1;
\ No newline at end of file
+ALTER TABLE `livestream_series` auto_increment = 1;
+ALTER TABLE `livestream_collaborators` auto_increment = 1;
+ALTER TABLE `users` auto_increment = 1;
+ALTER TABLE `sessions` auto_increment = 1;
+ALTER TABLE `api_tokens` auto_increment = 1;
+ALTER TABLE `audit_events` auto_increment = 1;
\ No newline at end of file
@@ -10,6 +10,48 @@ CREATE TABLE `users` (
   UNIQUE `uniq_user_name` (`name`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
+-- ログイン中のセッション
+CREATE TABLE `sessions` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  -- CookieのSESSIONIDのSHA-256
+  `token_hash` CHAR(64) NOT NULL,
+  `user_agent` VARCHAR(255) NOT NULL,
+  `ip_address` VARCHAR(64) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `last_seen_at` BIGINT NOT NULL,
+  `expires_at` BIGINT NOT NULL,
+  UNIQUE `uniq_token_hash` (`token_hash`),
+  INDEX `idx_user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- Bot・外部連携向けのAPIトークン
+CREATE TABLE `api_tokens` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `name` VARCHAR(255) NOT NULL,
+  -- トークンのSHA-256
+  `token_hash` CHAR(64) NOT NULL,
+  -- カンマ区切りのスコープ
+  `scopes` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `last_used_at` BIGINT NULL,
+  `expires_at` BIGINT NULL,
+  UNIQUE `uniq_token_hash` (`token_hash`),
+  INDEX `idx_user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 監査ログ (ログインのロックなど)
+CREATE TABLE `audit_events` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `event_type` VARCHAR(64) NOT NULL,
+  `username` VARCHAR(255) NOT NULL,
+  `ip_address` VARCHAR(64) NOT NULL,
+  `detail` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `idx_created_at` (`created_at`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
 -- プロフィール画像
 CREATE TABLE `icons` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
@@ -33,7 +75,46 @@ CREATE TABLE `livestreams` (
   `playlist_url` VARCHAR(255) NOT NULL,
   `thumbnail_url` VARCHAR(255) NOT NULL,
   `start_at` BIGINT NOT NULL,
-  `end_at` BIGINT NOT NULL
+  `end_at` BIGINT NOT NULL,
+  `series_id` BIGINT NULL,
+  `went_live_at` BIGINT NULL,
+  `ended_at` BIGINT NULL,
+  INDEX `idx_series_id` (`series_id`),
+  INDEX `idx_start_at` (`start_at`),
+  FULLTEXT INDEX `ft_title_description` (`title`, `description`) WITH PARSER ngram
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 繰り返し予約されたライブ配信のまとまり
+CREATE TABLE `livestream_series` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ライブ配信のコラボレーター
+CREATE TABLE `livestream_collaborators` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `status` VARCHAR(16) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_livestream_user` (`livestream_id`, `user_id`),
+  INDEX `idx_user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ライブコメントのモデレーション履歴
+CREATE TABLE `moderation_logs` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `livecomment_id` BIGINT NOT NULL,
+  -- 自動で非表示になった場合はNULL
+  `actor_id` BIGINT NULL,
+  -- hide, restore
+  `action` VARCHAR(16) NOT NULL,
+  -- ng_word:<id>, manual, report_threshold
+  `reason` VARCHAR(64) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `idx_livestream_id_created_at` (`livestream_id`, `created_at`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 -- ライブ配信予約枠
@@ -44,6 +125,16 @@ CREATE TABLE `reservation_slots` (
   `end_at` BIGINT NOT NULL
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
+-- ライブ配信の予約を受け付ける期間 (管理者が追加したもの)
+CREATE TABLE `reservation_terms` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `start_at` BIGINT NOT NULL,
+  `end_at` BIGINT NOT NULL,
+  `slot_duration` BIGINT NOT NULL,
+  `slot_capacity` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
 -- ライブストリームに付与される、サービスで定義されたタグ
 CREATE TABLE `tags` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
@@ -73,7 +164,12 @@ CREATE TABLE `livecomments` (
   `livestream_id` BIGINT NOT NULL,
   `comment` VARCHAR(255) NOT NULL,
   `tip` BIGINT NOT NULL DEFAULT 0,
-  `created_at` BIGINT NOT NULL
+  `created_at` BIGINT NOT NULL,
+  -- 非表示にされた時刻・理由・操作したユーザ
+  `hidden_at` BIGINT NULL,
+  `hidden_reason` VARCHAR(64) NULL,
+  `hidden_by` BIGINT NULL,
+  INDEX `idx_user_id_livestream_id` (`user_id`, `livestream_id`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 -- ユーザからのライブコメントのスパム報告
@@ -82,7 +178,42 @@ CREATE TABLE `livecomment_reports` (
   `user_id` BIGINT NOT NULL,
   `livestream_id` BIGINT NOT NULL,
   `livecomment_id` BIGINT NOT NULL,
-  `created_at` BIGINT NOT NULL
+  -- open, dismissed, actioned
+  `status` VARCHAR(16) NOT NULL DEFAULT 'open',
+  `created_at` BIGINT NOT NULL,
+  -- 配信者が対応した時刻・ユーザ
+  `resolved_at` BIGINT NULL,
+  `resolved_by` BIGINT NULL,
+  UNIQUE `uniq_livecomment_user` (`livecomment_id`, `user_id`),
+  INDEX `idx_livestream_id_status` (`livestream_id`, `status`),
+  INDEX `idx_livecomment_id_status_created_at` (`livecomment_id`, `status`, `created_at`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信ごとのモデレーション設定
+CREATE TABLE `livestream_moderation_settings` (
+  `livestream_id` BIGINT NOT NULL PRIMARY KEY,
+  -- 直近report_window_seconds秒間の報告者数がこれに達したら自動で非表示にする。0なら無効
+  `report_threshold` BIGINT NOT NULL,
+  `report_window_seconds` BIGINT NOT NULL,
+  -- 視聴者はこの秒数に1回だけコメントできる。0なら無効
+  `slow_mode_seconds` BIGINT NOT NULL DEFAULT 0,
+  `updated_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信者によるユーザのBAN・タイムアウト
+CREATE TABLE `livestream_bans` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `streamer_id` BIGINT NOT NULL,
+  -- 配信者のすべての配信に及ぶ場合はNULL
+  `livestream_id` BIGINT NULL,
+  `user_id` BIGINT NOT NULL,
+  `reason` VARCHAR(255) NOT NULL,
+  `created_by` BIGINT NOT NULL,
+  -- 無期限ならNULL
+  `expires_at` BIGINT NULL,
+  `created_at` BIGINT NOT NULL,
+  INDEX `idx_user_id_streamer_id` (`user_id`, `streamer_id`),
+  INDEX `idx_streamer_id_created_at` (`streamer_id`, `created_at`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 -- 配信者からのNGワード登録
@@ -91,9 +222,23 @@ CREATE TABLE `ng_words` (
   `user_id` BIGINT NOT NULL,
   `livestream_id` BIGINT NOT NULL,
   `word` VARCHAR(255) NOT NULL,
+  -- literal, whole_word, regex, wildcard
+  `match_type` VARCHAR(16) NOT NULL DEFAULT 'literal',
+  -- livestream, channel, global, shared
+  `scope` VARCHAR(16) NOT NULL DEFAULT 'livestream',
+  `list_id` BIGINT NULL,
   `created_at` BIGINT NOT NULL
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 CREATE INDEX ng_words_word ON ng_words(`word`);
+CREATE INDEX ng_words_scope_user_id ON ng_words(`scope`, `user_id`);
+CREATE INDEX ng_words_list_id ON ng_words(`list_id`);
+
+-- 管理者が用意する共有NGワードリスト
+CREATE TABLE `ng_word_lists` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `name` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
 -- ライブ配信に対するリアクション
 CREATE TABLE `reactions` (